@@ -0,0 +1,83 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Drainer is a server which a Server shuts down together with its own
+// listeners, listed in its Drainers field. It is meant for servers which do
+// not accept their connections through a net.Listener, such as an HTTP/3
+// server, whose QUIC sessions are carried over UDP, so that an adapter for
+// one can be plugged in without graceful depending on its library. An
+// *http.Server is a Drainer, and so are servers with the same shutdown
+// methods.
+type Drainer interface {
+	// Shutdown is called as soon as the Server's listeners are closed. It
+	// should stop accepting new connections or sessions at once, and
+	// return once those already active have finished, or ctx is done.
+	Shutdown(ctx context.Context) error
+
+	// Close is called, after the context given to Shutdown is done, if
+	// Shutdown has not returned by the time the Server forcefully closes
+	// its remaining connections. It should close any connections or
+	// sessions still active.
+	Close() error
+}
+
+// shutdownDrainers calls Shutdown on each of srv.Drainers, returning a
+// channel which is closed once they have all returned, and a function which
+// closes those which have not, returning how many it closed. A drainer whose
+// Shutdown panics is treated as having returned.
+func (srv *Server) shutdownDrainers() (<-chan struct{}, func() int) {
+	done := make(chan struct{})
+	if len(srv.Drainers) == 0 {
+		close(done)
+		return done, func() int { return 0 }
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var lock sync.Mutex
+	pending := make(map[int]Drainer, len(srv.Drainers))
+	var wg sync.WaitGroup
+	for i, d := range srv.Drainers {
+		i, d := i, d
+		pending[i] = d
+		wg.Add(1)
+		go srv.labeled("drainer", func() {
+			defer wg.Done()
+			var err error
+			srv.callHook("Drainer.Shutdown", func() { err = d.Shutdown(ctx) })
+			if err != nil && !errors.Is(err, context.Canceled) {
+				srv.logger().Printf("shutting down drainer failed: %v", err)
+			}
+			lock.Lock()
+			delete(pending, i)
+			lock.Unlock()
+		})
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(done)
+	}()
+
+	return done, func() int {
+		cancel()
+		lock.Lock()
+		left := make([]Drainer, 0, len(pending))
+		for _, d := range pending {
+			left = append(left, d)
+		}
+		lock.Unlock()
+		for _, d := range left {
+			var err error
+			srv.callHook("Drainer.Close", func() { err = d.Close() })
+			if err != nil {
+				srv.logger().Printf("closing drainer failed: %v", err)
+			}
+		}
+		return len(left)
+	}
+}
@@ -0,0 +1,204 @@
+package graceful
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingDrainer is a Drainer whose Shutdown returns once release is
+// closed or its context is done.
+type blockingDrainer struct {
+	release  chan struct{}
+	shutdown chan struct{}
+	closed   chan struct{}
+}
+
+func newBlockingDrainer() *blockingDrainer {
+	return &blockingDrainer{
+		release:  make(chan struct{}),
+		shutdown: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (d *blockingDrainer) Shutdown(ctx context.Context) error {
+	close(d.shutdown)
+	select {
+	case <-d.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *blockingDrainer) Close() error {
+	select {
+	case <-d.shutdown:
+	default:
+		return errors.New("closed before shutdown")
+	}
+	close(d.closed)
+	return nil
+}
+
+func TestDrainersWaited(t *testing.T) {
+	d := newBlockingDrainer()
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		Drainers:         []Drainer{d},
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	select {
+	case <-d.shutdown:
+		t.Fatal("Expected the drainer not to be shut down while serving")
+	case <-time.After(waitTime):
+	}
+
+	srv.Stop(timeoutTime)
+	select {
+	case <-d.shutdown:
+	case <-time.After(killTime):
+		t.Fatal("Expected the drainer to be shut down with the listeners")
+	}
+	select {
+	case <-stopped:
+		t.Fatal("Expected the shutdown to wait for the drainer")
+	case <-time.After(waitTime):
+	}
+
+	close(d.release)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Expected a clean shutdown. Got %v", err)
+		}
+	case <-time.After(killTime):
+		t.Fatal("Expected the shutdown to finish once the drainer had")
+	}
+	select {
+	case <-d.closed:
+		t.Error("Expected a drainer which finished not to be closed")
+	default:
+	}
+}
+
+func TestDrainersClosedOnTimeout(t *testing.T) {
+	d := newBlockingDrainer()
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Drainers:         []Drainer{d},
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	srv.Stop(killTime)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrDrainTimeout) {
+			t.Errorf("Expected ErrDrainTimeout. Got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected the shutdown to be bounded by the timeout")
+	}
+	select {
+	case <-d.closed:
+	default:
+		t.Error("Expected the drainer to be closed once the timeout expired")
+	}
+}
+
+func TestHTTPServerDrainer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &http.Server{Handler: http.NewServeMux()}
+	served := make(chan error, 1)
+	go func() { served <- other.Serve(l) }()
+
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Drainers:         []Drainer{other},
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	go srv.ListenAndServe()
+	<-srv.Ready()
+	srv.Stop(killTime)
+
+	select {
+	case err := <-served:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Expected the other server to be shut down. Got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected the other server to stop serving")
+	}
+}
+
+// panickingDrainer is a Drainer whose Close panics, as does its Shutdown
+// unless it is set to block until its context is done.
+type panickingDrainer struct {
+	block bool
+}
+
+func (d panickingDrainer) Shutdown(ctx context.Context) error {
+	if d.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	panic("drainer shutdown")
+}
+
+func (d panickingDrainer) Close() error {
+	panic("drainer close")
+}
+
+func TestPanickingDrainer(t *testing.T) {
+	for _, block := range []bool{false, true} {
+		var buf bytes.Buffer
+		srv := &Server{
+			Timeout:          waitTime,
+			NoSignalHandling: true,
+			Logger:           log.New(&buf, "", 0),
+			Drainers:         []Drainer{panickingDrainer{block: block}},
+			Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+		}
+		errc := make(chan error, 1)
+		go func() { errc <- srv.ListenAndServe() }()
+		<-srv.Ready()
+
+		srv.Stop(waitTime)
+		select {
+		case err := <-errc:
+			if block && !errors.Is(err, ErrDrainTimeout) || !block && err != nil {
+				t.Errorf("Unexpected error with a blocking drainer %v: %v", block, err)
+			}
+		case <-time.After(timeoutTime):
+			t.Fatal("Expected the shutdown to finish despite the panic")
+		}
+		want := "panic in Drainer.Shutdown: drainer shutdown"
+		if block {
+			want = "panic in Drainer.Close: drainer close"
+		}
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q to be logged. Got %q", want, buf.String())
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package graceful
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/pprof"
+	"sort"
+	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/netutil"
@@ -18,6 +26,11 @@ import (
 // It may be used directly in the same way as http.Server, or may
 // be constructed with the global functions in this package.
 //
+// Server tracks its connections itself instead of calling
+// http.Server.Shutdown, so the embedded http.Server remains usable
+// once a shutdown has completed. The Server itself may then be served
+// again, for example to cycle it on a configuration reload.
+//
 // Example:
 //	srv := &graceful.Server{
 //		Timeout: 5 * time.Second,
@@ -25,66 +38,884 @@ import (
 //	}
 //	srv.ListenAndServe()
 type Server struct {
+	// totalConnections counts the connections accepted since the Server
+	// was created, and killedConnections those closed forcefully by its
+	// shutdowns. They are accessed atomically, and come first to be 64-bit
+	// aligned on 32-bit platforms, as do the fields below.
+	totalConnections  uint64
+	killedConnections uint64
+
+	// durations holds how long the last recentRequests requests took to
+	// serve, for DrainPreview, in nanoseconds: the nth request served goes
+	// in slot (n-1) % recentRequests, n being counted by requests. Both are
+	// accessed atomically, so that serving does not contend on a lock.
+	requests  uint64
+	durations [recentRequests]int64
+
+	// Server is the http.Server being served, whose fields, such as
+	// MaxHeaderBytes or ConnContext, may be set before serving. Graceful
+	// owns ConnState, which it wraps along with the Handler, BaseContext
+	// and ConnContext set here, as well as the lifetime of the listeners:
+	// use Stop or Shutdown rather than the http.Server's Shutdown or Close.
 	*http.Server
 
 	// Timeout is the duration to allow outstanding requests to survive
-	// before forcefully terminating them.
+	// before forcefully terminating them. If 0, shutdown waits for all
+	// requests to finish, however long they take. If negative, connections
+	// are closed as soon as the listener is, without draining them.
 	Timeout time.Duration
 
+	// ConnectionTimeout is the duration each active connection is allowed
+	// to survive once shutdown begins. When it expires, a deadline is set
+	// on the connection and it is closed, so that a single stalled client
+	// cannot hold up the shutdown for the whole Timeout. If 0, connections
+	// are only limited by Timeout.
+	ConnectionTimeout time.Duration
+
+	// SafeRequestTimeout, if set, closes the active connections serving
+	// only safe requests, those using GET, HEAD, OPTIONS or TRACE, once it
+	// has passed since draining began. Connections serving any other
+	// request, which may be a write, are left the whole Timeout, so that a
+	// shutdown is less likely to leave a write half applied. Requests are
+	// tagged through the connection's base context, which wraps any
+	// ConnContext of the http.Server.
+	SafeRequestTimeout time.Duration
+
+	// DrainReadTimeout, if set, is a read deadline set once draining begins
+	// on the connections whose request body is still being read, so that a
+	// stalled upload fails quickly, rather than holding the connection until
+	// Timeout and being cut off with its handler part way through. Uploads
+	// which finish within DrainReadTimeout are unaffected. The deadline is
+	// removed once the handler has read the whole body.
+	DrainReadTimeout time.Duration
+
+	// KillGrace is the duration remaining connections are given once Timeout
+	// expires. A deadline is set on each of them, giving clients a last chance
+	// to finish, and whatever remains is closed once KillGrace has passed.
+	// If 0, connections are closed as soon as Timeout expires.
+	KillGrace time.Duration
+
+	// ExtendDrain is an optional function consulted with the number of
+	// connections remaining when Timeout expires, before KillGrace. If it
+	// returns a positive duration, the drain is extended by that long, and
+	// it is consulted again if connections still remain; otherwise they are
+	// closed. This allows slow clients which are still making progress to
+	// finish.
+	ExtendDrain func(remaining int) time.Duration
+
+	// MaxDrainExtensions bounds the number of times the drain may be
+	// extended by ExtendDrain. If 0, it is extended at most 3 times.
+	MaxDrainExtensions int
+
+	// EvictAge, when set along with a positive Timeout, starts closing
+	// connections which have been active for longer than EvictAge once the
+	// last tenth of Timeout is reached. They are closed oldest first and
+	// spread out over that time, so that very old connections are not all
+	// killed at once when Timeout expires.
+	EvictAge time.Duration
+
+	// RequestPriority, when set along with a positive Timeout, classifies
+	// each request by priority, for instance from a header, so that the
+	// most important requests are given the whole Timeout. Once the last
+	// tenth of Timeout is reached, active connections serving requests of
+	// a lower priority than the highest still being served are closed,
+	// lowest priority first and spread out over that time, leaving those of
+	// the highest priority until Timeout expires. A connection serving
+	// several requests, over HTTP/2, takes the highest of their priorities.
+	// If nil, all requests are treated equally.
+	RequestPriority func(r *http.Request) int
+
+	// DrainLogInterval is the interval at which the number of connections
+	// still open is logged while draining. If 0, progress is not logged.
+	DrainLogInterval time.Duration
+
+	// WarnActiveAfter, if set, logs a warning while draining for each
+	// connection that has been active for longer than WarnActiveAfter, with
+	// its remote address, to explain why a drain is slow. It is only
+	// diagnostic: the connections are left to finish or be evicted.
+	WarnActiveAfter time.Duration
+
+	// ShutdownDelay is the duration to keep serving normally once shutdown
+	// is initiated, before the listener is closed and connections are
+	// drained. ShutdownInitiated is called at the start of the delay, so it
+	// can be used to fail a readiness probe and give a load balancer time
+	// to stop sending traffic. If 0, the listener is closed immediately.
+	ShutdownDelay time.Duration
+
+	// ShutdownJitter adds a random duration of up to ShutdownJitter to
+	// ShutdownDelay, so that a fleet of instances stopped at once do not
+	// close their listeners at the same instant, and their clients do not
+	// reconnect elsewhere in a single burst.
+	ShutdownJitter time.Duration
+
+	// MaxShutdownTime, if set, bounds the whole shutdown, from the moment
+	// it is initiated, across ShutdownDelay, Timeout, ExtendDrain and
+	// KillGrace, for instance to finish within an orchestrator's grace
+	// period before it kills the process. If the phases would take longer,
+	// they are compressed to fit, which is logged: the ShutdownDelay and
+	// KillGrace are kept if they fit within it, and scaled down together
+	// otherwise, and the drain is given whatever remains, shortening
+	// Timeout; EvictAge and RequestPriority then act during the last tenth
+	// of the shortened drain. Connections still open once MaxShutdownTime
+	// has passed are closed, as on a second signal.
+	MaxShutdownTime time.Duration
+
+	// JitterSource is the source of randomness for ShutdownJitter. If nil,
+	// the default source of math/rand is used. Setting a seeded source
+	// makes the delay deterministic, for example in tests.
+	JitterSource rand.Source
+
+	// DrainKeepAlives disables keep-alives as soon as shutdown is initiated,
+	// at the start of ShutdownDelay, so that clients stop reusing their
+	// connections before the listener is closed. Every HTTP/1 response
+	// written from then on, including those of requests already in flight,
+	// carries "Connection: close", and idle connections are closed.
+	// Otherwise keep-alives are disabled once the delay is over.
+	// Keep-alives may also be disabled at any time with
+	// SetKeepAlivesEnabled.
+	DrainKeepAlives bool
+
+	// KeepAliveTimeout and KeepAliveMax, if either is set, are advertised to
+	// HTTP/1 clients in a Keep-Alive header, such as "timeout=5, max=100",
+	// on every response, for the clients which honour it. They are tightened
+	// during the ShutdownDelay, so that clients move to fresh connections
+	// elsewhere before draining begins: the timeout never exceeds the time
+	// left until the listener is closed, rounded down to whole seconds but
+	// at least 1, and the maximum shrinks in proportion to it, down to 1.
+	// Once keep-alives are disabled, by DrainKeepAlives or at the end of the
+	// delay, responses carry "Connection: close" instead and the header is
+	// no longer sent, so clients which followed it have already left and
+	// the drain, which Timeout bounds, only waits for requests in flight.
+	// Neither changes how long the server keeps idle connections open,
+	// which is set by IdleTimeout.
+	KeepAliveTimeout time.Duration
+	KeepAliveMax     int
+
 	// Limit the number of outstanding requests
 	ListenLimit int
 
+	// MaxConnections limits the number of connections managed at once.
+	// Unlike ListenLimit, which stops accepting until a connection is
+	// closed, new connections over the limit are accepted and closed
+	// immediately. If 0, the number of connections is unlimited.
+	MaxConnections int
+
+	// H2C enables HTTP/2 over cleartext connections with prior knowledge,
+	// alongside HTTP/1. Requires Go 1.24 or later.
+	H2C bool
+
+	// Network is the network passed to net.Listen, such as "tcp4", "tcp6"
+	// or "unix". If empty, "tcp" is used. When serving on a unix socket,
+	// the socket file is removed on shutdown, unless UnlinkOnShutdown
+	// says otherwise.
+	Network string
+
+	// UnlinkOnShutdown sets whether the file of a unix socket being served
+	// is removed on shutdown. If nil, sockets the Server listens on itself
+	// are removed, and those passed to Serve or ServeListeners are left in
+	// place, for instance to be reused through socket activation. A socket
+	// file which has already been removed is not an error.
+	UnlinkOnShutdown *bool
+
+	// ListenConfig is used to create the listener, if set, so that socket
+	// options such as SO_REUSEPORT can be set in its Control function
+	// before listening. If nil, net.Listen is used.
+	ListenConfig *net.ListenConfig
+
 	// ConnState specifies an optional callback function that is
 	// called when a client connection changes state. This is a proxy
-	// to the underlying http.Server's ConnState, and the original
-	// must not be set directly.
+	// to the underlying http.Server's ConnState. If the underlying
+	// http.Server already has a ConnState callback, it is preserved
+	// and called before this one.
+	//
+	// It is called for every transition of every connection, including
+	// connections rejected by MaxConnections and those closed during
+	// shutdown, before graceful updates its own bookkeeping. It is called
+	// on the connection's goroutine, so it should not block; it may be
+	// used to record connection lifecycle events for tracing or metrics.
 	ConnState func(net.Conn, http.ConnState)
 
 	// ShutdownInitiated is an optional callback function that is called
-	// when shutdown is initiated. It can be used to notify the client
+	// when shutdown is initiated, just before the listener is closed and
+	// outstanding connections are drained. It can be used to notify the client
 	// side of long lived connections (e.g. websockets) to reconnect.
 	ShutdownInitiated func()
 
+	// OnListenerClosed is an optional callback function that is called as
+	// soon as the listeners have been closed, from which point no new
+	// connections are accepted. It follows ShutdownInitiated by the
+	// ShutdownDelay, and marks the start of the drain measured by
+	// ShutdownStats.Drain, for instance to tell a load balancer the exact
+	// moment traffic stopped.
+	OnListenerClosed func()
+
+	// ShutdownCompleted is an optional callback function that is called
+	// once all connections have finished, or have been closed because the
+	// timeout expired, and before the stop channel is closed. It can be
+	// used to perform final cleanup.
+	ShutdownCompleted func()
+
+	// ConnectionsKilled is an optional callback function that is called
+	// once shutdown has finished, with the number of connections that were
+	// forcefully closed because the timeout expired. It is called with 0
+	// when all connections finished on their own.
+	ConnectionsKilled func(n int)
+
+	// CloseHandler closes the Handler of the underlying http.Server once
+	// its connections have drained or been closed, if it implements
+	// io.Closer, so that resources it owns are released as part of the
+	// shutdown. An error from Close is returned by Serve unless shutdown
+	// already failed, in which case it is logged.
+	CloseHandler bool
+
+	// CanComplete is an optional function consulted once all connections
+	// have drained. While it returns false the shutdown waits, checking it
+	// again every 100ms, still bounded by Timeout. This lets a coordinator
+	// hold the shutdown of an instance until replacement capacity is ready.
+	// If it panics, the shutdown is allowed to complete.
+	CanComplete func() bool
+
+	// WaitGroup, if set, represents background work the shutdown waits for
+	// once all connections have drained, still bounded by Timeout, as it
+	// does for tasks registered with Track.
+	WaitGroup *sync.WaitGroup
+
+	// OnForceClose is an optional callback function that is called with
+	// each connection about to be forcefully closed, for example to flush
+	// a buffered response or tell the client it was truncated, as responses
+	// still being written are otherwise cut short without notice. A write
+	// deadline of 100ms is set on the connection beforehand, so that a stuck
+	// write cannot hold up the shutdown.
+	OnForceClose func(conn net.Conn)
+
+	// SkipDrain is an optional function which reports whether an active
+	// connection, such as one streaming server-sent events, is never
+	// expected to finish on its own. It is consulted whenever a connection
+	// becomes active, and again for the active connections when draining
+	// begins, so it may rely on a flag set by the connection's handler.
+	// Shutdown does not wait for the connections it returns true for: they
+	// are closed as soon as all the other connections have finished.
+	SkipDrain func(conn net.Conn) bool
+
+	// ShouldKill is an optional function consulted for each connection when
+	// the remaining connections are forcefully closed. Connections for
+	// which it returns false are left open and no longer managed. When it
+	// is nil, all remaining connections are closed.
+	ShouldKill func(conn net.Conn) bool
+
+	// Tracker, if set, is kept in step with the connections the Server
+	// manages, and its CloseAll is called when the remaining connections
+	// are forcefully closed, after those spared by ShouldKill have been
+	// removed from it and before the Server closes the rest itself. It
+	// does not replace the Server's own bookkeeping, which decides when
+	// draining has finished. If nil, only the Server's own bookkeeping is
+	// used.
+	Tracker ConnTracker
+
+	// Drainers are shut down alongside the listeners, so that servers which
+	// do not serve a net.Listener, such as an HTTP/3 server over QUIC for
+	// the same handler, drain together with this one. Each is told to stop
+	// accepting as soon as the listeners are closed, and the shutdown waits
+	// for them as it does for connections; those still draining when the
+	// remaining connections are forcefully closed are closed too, and are
+	// not listed in the DrainTimeoutError.
+	Drainers []Drainer
+
+	// ShutdownReported is an optional callback function that is called once
+	// shutdown has finished, after ConnectionsKilled, with statistics about
+	// how the connections were drained. It can be used to export metrics.
+	ShutdownReported func(stats ShutdownStats)
+
+	// OnShutdownEvent is an optional callback function that is called at
+	// each step of a shutdown with the number of connections open at that
+	// point, for instance to record the shutdown as a tracing span. The
+	// first event is always EventShutdownInitiated, and the last either
+	// EventDrainComplete or EventConnectionsKilled.
+	OnShutdownEvent func(event ShutdownEvent, connections int)
+
+	// OnHijackedShutdown is an optional callback function that is called,
+	// in its own goroutine, for every hijacked connection once connections
+	// start draining, for example to send a WebSocket close frame. Hijacked
+	// connections do not delay shutdown, but those still open when the
+	// timeout expires are closed along with the remaining connections.
+	OnHijackedShutdown func(conn net.Conn)
+
+	// CountRequests counts every request being served, as TrackRequests
+	// does for the handler it wraps, so that shutdown waits for requests to
+	// return as well as for connections to close, within Timeout.
+	CountRequests bool
+
+	// CancelOnShutdown cancels the context of every request once the
+	// listener is closed and connections start draining, so that handlers
+	// using the request context can abort their work early. A BaseContext
+	// set on the underlying http.Server is preserved, and the contexts it
+	// returns are cancelled too.
+	CancelOnShutdown bool
+
+	// RetryAccept is an optional callback function that is called when
+	// accepting a connection fails, other than because the server is
+	// shutting down. If it returns true, accepting is retried after a short
+	// delay, which doubles on each consecutive failure up to a second.
+	// Otherwise the error is handled by the http.Server as usual, which
+	// stops serving unless the error is temporary.
+	RetryAccept func(err error) bool
+
 	// NoSignalHandling prevents graceful from automatically shutting down
-	// on SIGINT and SIGTERM. If set to true, you must shut down the server
-	// manually with Stop().
+	// on SIGINT and SIGTERM, or os.Interrupt on Windows. If set to true,
+	// you must shut down the server manually with Stop().
 	NoSignalHandling bool
 
+	// NoConnectionTracking stops graceful from keeping track of the
+	// server's connections, so that it serves like a plain http.Server,
+	// for instance to benchmark it and measure what the tracking costs.
+	// This forfeits the graceful shutdown: the listener is still closed on
+	// a signal or Stop, but Serve then returns without waiting for the
+	// connections to finish, and none are ever closed by the timeout. Only
+	// requests and tasks registered with TrackRequests and Track are still
+	// waited for. ActiveConnections and TotalConnections report 0, and
+	// the options which act on connections, such as MaxConnections,
+	// SkipDrain, WarnActiveAfter and Tracker, have no effect.
+	NoConnectionTracking bool
+
+	// Signals is the set of signals which initiate a graceful shutdown.
+	// If empty, SIGINT and SIGTERM are used, or os.Interrupt on Windows.
+	Signals []os.Signal
+
+	// Logger is used to report shutdown progress and errors. If nil,
+	// DefaultLogger() is used.
+	Logger *log.Logger
+
+	// RestartSignal is an optional signal, such as SIGHUP, which restarts
+	// the server without dropping connections: see Restart. It is ignored
+	// if NoSignalHandling is set.
+	RestartSignal os.Signal
+
+	// ShutdownFile is an optional path which is polled while serving, every
+	// ShutdownFileInterval or every second if that is 0. Creating the file,
+	// or changing it once it exists, initiates a shutdown as Stop(Timeout)
+	// would, for environments where the process cannot be signalled. It is
+	// not removed by graceful, so a file left in place does not stop the
+	// next process; the state it is in when serving begins is taken as the
+	// starting point.
+	ShutdownFile         string
+	ShutdownFileInterval time.Duration
+
 	// interrupt signals the listener to stop serving connections,
 	// and the server to shut down.
 	interrupt chan os.Signal
 
+	// callerInterrupt is set when interrupt was supplied by the caller of
+	// ServeWithSignalChan, in which case it is never closed by graceful.
+	callerInterrupt bool
+
 	// stopChan is the channel on which callers may block while waiting for
 	// the server to stop.
 	stopChan chan struct{}
 
-	// stopLock is used to protect access to the stopChan.
+	// shuttingDown is closed as soon as shutdown is initiated.
+	shuttingDown chan struct{}
+
+	// events is the channel returned by Events, created by its first call.
+	events chan Event
+
+	// ready is closed once the server is about to accept connections.
+	ready chan struct{}
+
+	// stopLock is used to protect access to the stopChan, shuttingDown,
+	// ready, interrupt, stopping, unbounded and finished.
 	stopLock sync.RWMutex
 
-	// connections holds all connections managed by graceful
-	connections map[net.Conn]struct{}
+	// stopping is set once a shutdown has been initiated, either by a
+	// signal or by a call to Stop.
+	stopping bool
+
+	// unbounded is set when the shutdown was initiated by Shutdown, whose
+	// context bounds the drain in place of Timeout.
+	unbounded bool
+
+	// finished is set once a shutdown has completed, so that the next call
+	// to Serve starts afresh instead of returning ErrServerStopped.
+	finished bool
+
+	// connections holds all connections managed by graceful, along
+	// with their ID and whether they are currently idle or active. It is
+	// nil when connections are not being managed.
+	connections map[net.Conn]connInfo
+
+	// lastConnID is the ID given to the most recently tracked connection.
+	lastConnID uint64
+
+	// drained is set once shutdown begins, and is closed when the last
+	// managed connection is removed.
+	drained chan struct{}
+
+	// tasks counts the requests and tasks registered with TrackRequests and
+	// Track, and tasksDone is closed once it drops to zero while shutdown is
+	// waiting for it.
+	tasks     int
+	tasksDone chan struct{}
+
+	// drainPeak is the largest number of connections managed since
+	// draining began.
+	drainPeak int
+
+	// hijacked holds connections taken over by their handler, and their
+	// IDs, until they are released with ReleaseHijacked.
+	hijacked map[net.Conn]uint64
+
+	// skipped holds the connections SkipDrain reported as not draining,
+	// and their state, from the end of the drain until they are closed.
+	skipped map[net.Conn]connInfo
+
+	// immediate holds the open connections accepted from listeners wrapped
+	// with ImmediateClose, which are closed when draining begins rather
+	// than managed.
+	immediate map[net.Conn]struct{}
+
+	// drainersDone is closed once the Drainers of the current drain have
+	// shut down, and closeDrainers closes any still shutting down,
+	// returning how many there were.
+	drainersDone  <-chan struct{}
+	closeDrainers func() int
+
+	// connLock is used to protect access to connections, lastConnID,
+	// drained, tasks, tasksDone, drainPeak, hijacked, skipped, immediate,
+	// drainersDone and closeDrainers. Connection state
+	// changes and shutdown take it in turn, so shutdown cannot be starved
+	// by a steady stream of state changes, and once the listeners are
+	// closed the only new connections are those already accepted.
+	connLock sync.Mutex
+
+	// serverConnState is the ConnState callback originally set on the
+	// underlying http.Server, captured the first time Serve is called.
+	serverConnState func(net.Conn, http.ConnState)
+
+	// connStateInstalled reports whether graceful has replaced the
+	// underlying http.Server's ConnState with its own.
+	connStateInstalled bool
+
+	// handler holds the reloadable wrapping the handler requests are
+	// dispatched to, once handlerInstalled is set and the http.Server's
+	// Handler has been replaced by serveHTTP.
+	handler          atomic.Value
+	handlerInstalled bool
+
+	// serverBaseContext and baseContextInstalled are the BaseContext
+	// equivalents of serverConnState and connStateInstalled.
+	serverBaseContext    func(net.Listener) context.Context
+	baseContextInstalled bool
+
+	// serverConnContext and connContextInstalled are the ConnContext
+	// equivalents of serverConnState and connStateInstalled.
+	serverConnContext    func(context.Context, net.Conn) context.Context
+	connContextInstalled bool
+
+	// forceClose closes all remaining connections of the current call to
+	// Serve once it is draining. It is protected by stopLock.
+	forceClose func()
+
+	// cancelRequests cancels the base context of requests when
+	// CancelOnShutdown is set. It is protected by stopLock.
+	cancelRequests context.CancelFunc
+
+	// listener is the listener created by listen, and handedOff is set
+	// once it has been passed to a new process by Restart. Both are
+	// protected by stopLock.
+	listener  net.Listener
+	handedOff bool
+
+	// serving holds the addresses being served, which label the server's
+	// goroutines. It is protected by stopLock.
+	serving string
+
+	// initiated is when the current shutdown was initiated, reported as
+	// ShutdownStats.Shutdown, closing when its listeners are to be closed,
+	// at the end of the ShutdownDelay, deadline when MaxShutdownTime will
+	// have passed, if set, and drainUntil when the drain times out, once it
+	// has started with a Timeout. They are protected by stopLock.
+	initiated  time.Time
+	closing    time.Time
+	deadline   time.Time
+	drainUntil time.Time
+
+	// scaledGrace is the KillGrace of the current shutdown, scaled down
+	// along with the ShutdownDelay to fit MaxShutdownTime. It is set with
+	// closing, and is protected by stopLock.
+	scaledGrace time.Duration
+
+	// lastShutdown holds the statistics of the last completed shutdown, if
+	// shutDown is set. Both are protected by stopLock.
+	lastShutdown ShutdownStats
+	shutDown     bool
+}
+
+// forceCloseWriteTimeout is the write deadline set on a connection before it
+// is passed to OnForceClose.
+var forceCloseWriteTimeout = 100 * time.Millisecond
+
+// defaultDrainExtensions is the number of times ExtendDrain may extend the
+// drain when MaxDrainExtensions is 0.
+const defaultDrainExtensions = 3
+
+// activeCheckInterval is how often connections are checked against
+// WarnActiveAfter while draining.
+var activeCheckInterval = time.Second
+
+// defaultShutdownFileInterval is how often ShutdownFile is polled when
+// ShutdownFileInterval is 0.
+const defaultShutdownFileInterval = time.Second
+
+// recentRequests is the number of requests whose durations DrainPreview
+// bases its estimates on.
+const recentRequests = 256
+
+// canCompleteInterval is how often CanComplete is consulted while it holds
+// up the shutdown.
+var canCompleteInterval = 100 * time.Millisecond
+
+// serveStopTimeout is the longest time to wait for http.Server.Serve to
+// return once its listener has been closed.
+var serveStopTimeout = 10 * time.Second
+
+// ErrServerStopped is returned by the Serve and ListenAndServe methods when
+// the server has already been stopped, by a signal or a call to Stop, before
+// it started serving. A server whose shutdown has completed may be served
+// again.
+var ErrServerStopped = errors.New("graceful: server stopped")
+
+// ErrDrainTimeout is returned by the Serve and ListenAndServe methods when
+// connections were still open once the timeout expired, or a second signal
+// was received, and had to be closed. It is wrapped in a DrainTimeoutError,
+// so it should be tested for with errors.Is. A shutdown which drained all
+// connections returns nil.
+var ErrDrainTimeout = errors.New("graceful: connections closed before they finished")
+
+// DrainTimeoutError is the error returned in place of ErrDrainTimeout, which
+// it matches with errors.Is, describing the connections which had to be
+// closed. It can be retrieved with errors.As, to log or alert on what was
+// left:
+//
+//	var timeoutErr *graceful.DrainTimeoutError
+//	if errors.As(err, &timeoutErr) {
+//		for _, c := range timeoutErr.Remaining {
+//			log.Printf("closed #%d from %s, active for %v", c.ID, c.RemoteAddr, c.Active)
+//		}
+//	}
+type DrainTimeoutError struct {
+	// Remaining holds the connections which were closed, in order of ID.
+	// Connections spared by ShouldKill are not included.
+	Remaining []ConnInfo
+}
+
+func (e *DrainTimeoutError) Error() string {
+	return fmt.Sprintf("%v: %d remaining", ErrDrainTimeout, len(e.Remaining))
+}
+
+// Unwrap returns ErrDrainTimeout.
+func (e *DrainTimeoutError) Unwrap() error {
+	return ErrDrainTimeout
+}
+
+// ConnInfo describes a connection which was still open when a drain timed
+// out.
+type ConnInfo struct {
+	// ID is the connection's ID, as returned by ConnectionID.
+	ID uint64
+
+	// RemoteAddr is the address of the client.
+	RemoteAddr net.Addr
+
+	// State is the last state of the connection, which is StateHijacked
+	// for a connection taken over by its handler.
+	State http.ConnState
+
+	// Active is how long the connection had been serving its current
+	// request, if State is StateActive.
+	Active time.Duration
 }
 
+// ShutdownStats describes how a shutdown drained its connections. It is
+// passed to the ShutdownReported callback, and returned by LastShutdown.
+type ShutdownStats struct {
+	// Drain is the time from the listener being closed until all
+	// connections finished or were closed.
+	Drain time.Duration
+
+	// Shutdown is the time from the shutdown being initiated, by a signal
+	// or a call to Stop, until it finished. Unlike Drain it includes the
+	// ShutdownDelay, so it is the time a signalled process takes to exit,
+	// and is close to the Timeout when connections had to be killed.
+	Shutdown time.Duration
+
+	// PeakConnections is the largest number of connections open at once
+	// while draining.
+	PeakConnections int
+
+	// ConnectionsKilled is the number of connections closed because the
+	// timeout expired or a second signal was received.
+	ConnectionsKilled int
+
+	// TimedOut reports whether the timeout expired before all connections
+	// finished.
+	TimedOut bool
+}
+
+// ShutdownEvent names a step of a shutdown reported to OnShutdownEvent and
+// sent on the channel returned by Events.
+type ShutdownEvent string
+
+// The events reported to OnShutdownEvent and Events, in the order they
+// occur.
+const (
+	// EventShutdownInitiated is reported as soon as a shutdown begins,
+	// when ShutdownInitiated is called, or when the drain begins if serving
+	// stopped on its own, as on a listener error.
+	EventShutdownInitiated ShutdownEvent = "shutdown initiated"
+
+	// EventListenerClosed is reported once the listeners are closed and
+	// connections start draining, after any ShutdownDelay.
+	EventListenerClosed ShutdownEvent = "listener closed"
+
+	// EventConnectionsRemaining is reported every DrainLogInterval while
+	// draining.
+	EventConnectionsRemaining ShutdownEvent = "connections remaining"
+
+	// EventDrainComplete is reported once all connections have finished.
+	EventDrainComplete ShutdownEvent = "drain complete"
+
+	// EventConnectionsKilled is reported instead of EventDrainComplete when
+	// the remaining connections had to be closed, with how many there were.
+	EventConnectionsKilled ShutdownEvent = "connections killed"
+)
+
+// Event is a step of a shutdown, as sent on the channel returned by
+// Server.Events.
+type Event struct {
+	// Kind is the step of the shutdown.
+	Kind ShutdownEvent
+
+	// Connections is the number of connections open at that point, or
+	// for EventConnectionsKilled, the number which were closed.
+	Connections int
+
+	// Time is when the event occurred.
+	Time time.Time
+}
+
+// eventBuffer is the number of events the channel returned by Events holds
+// before further events are dropped.
+const eventBuffer = 64
+
 // Run serves the http.Handler with graceful shutdown enabled.
 //
 // timeout is the duration to wait until killing active requests and stopping the server.
 // If timeout is 0, the server never times out. It waits for all active requests to finish.
 func Run(addr string, timeout time.Duration, n http.Handler) {
+	RunWithSignals(addr, timeout, n)
+}
+
+// RunWithSignals is equivalent to Run, but shuts down gracefully when any of
+// sigs is received. If no signals are given, SIGINT and SIGTERM are used, or
+// os.Interrupt on Windows.
+func RunWithSignals(addr string, timeout time.Duration, n http.Handler, sigs ...os.Signal) {
+	srv := &Server{
+		Timeout: timeout,
+		Signals: sigs,
+		Server:  &http.Server{Addr: addr, Handler: n},
+	}
+
+	fatal(srv.ListenAndServe())
+}
+
+// RunMux is equivalent to Run, but serves several handlers, each under its
+// own path prefix, such as an admin handler under "/admin/" beside the main
+// handler under "/". The prefixes are patterns registered with an
+// http.ServeMux, so one ending in a slash matches every path below it, and
+// a request is served by the handler with the longest matching prefix.
+//
+// timeout is the duration to wait until killing active requests and stopping the server.
+// If timeout is 0, the server never times out. It waits for all active requests to finish.
+func RunMux(addr string, timeout time.Duration, handlers map[string]http.Handler) {
+	Run(addr, timeout, prefixMux(handlers))
+}
+
+// prefixMux returns a ServeMux serving each handler under its prefix.
+func prefixMux(handlers map[string]http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	for prefix, h := range handlers {
+		mux.Handle(prefix, h)
+	}
+	return mux
+}
+
+// FatalHandler is called by Run, RunWithSignals, RunMux and RunNetwork with the error
+// which stopped the server, if it failed rather than shutting down. It logs
+// the error with DefaultLogger and exits the process by default. It may be
+// replaced, for instance to flush telemetry before exiting, or to record the
+// error in tests. It should be set before the server is started.
+var FatalHandler = func(err error) {
+	DefaultLogger().Fatal(err)
+}
+
+// fatal calls FatalHandler with err, unless err is the result of a shutdown.
+func fatal(err error) {
+	if err == nil || errors.Is(err, ErrDrainTimeout) {
+		return
+	}
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "accept" {
+		return
+	}
+	FatalHandler(err)
+}
+
+// DefaultLogger returns the logger used by graceful when Server.Logger is nil.
+func DefaultLogger() *log.Logger {
+	return log.New(os.Stdout, "[graceful] ", 0)
+}
+
+// RunNetwork is equivalent to Run, but listens on the given network, such as
+// "tcp4", "tcp6" or "unix", instead of "tcp". For unix sockets addr is the
+// path of the socket file, which is removed on shutdown.
+func RunNetwork(network, addr string, timeout time.Duration, n http.Handler) {
+	srv := &Server{
+		Timeout: timeout,
+		Network: network,
+		Server:  &http.Server{Addr: addr, Handler: n},
+	}
+
+	fatal(srv.ListenAndServe())
+}
+
+// RunErr is equivalent to Run, but returns the error to the caller instead
+// of logging it and exiting the process. This allows callers to perform
+// their own cleanup when, for instance, the listener fails to bind.
+//
+// timeout is the duration to wait until killing active requests and stopping the server.
+// If timeout is 0, the server never times out. It waits for all active requests to finish.
+func RunErr(addr string, timeout time.Duration, n http.Handler) error {
+	srv := &Server{
+		Timeout: timeout,
+		Server:  &http.Server{Addr: addr, Handler: n},
+	}
+
+	return srv.ListenAndServe()
+}
+
+// RunTLS is equivalent to RunErr, but serves HTTPS using the certificate and
+// key in certFile and keyFile.
+//
+// timeout is the duration to wait until killing active requests and stopping the server.
+// If timeout is 0, the server never times out. It waits for all active requests to finish.
+func RunTLS(addr string, certFile, keyFile string, timeout time.Duration, n http.Handler) error {
 	srv := &Server{
 		Timeout: timeout,
 		Server:  &http.Server{Addr: addr, Handler: n},
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
-		if opErr, ok := err.(*net.OpError); !ok || (ok && opErr.Op != "accept") {
-			logger := log.New(os.Stdout, "[graceful] ", 0)
-			logger.Fatal(err)
+	return srv.ListenAndServeTLS(certFile, keyFile)
+}
+
+// RunTLSConfig is equivalent to RunTLS, but serves HTTPS using cfg, which
+// allows for client certificate verification or certificates that are
+// rotated through cfg.GetCertificate. TLS connections are drained in the
+// same way as plaintext ones.
+//
+// timeout is the duration to wait until killing active requests and stopping the server.
+// If timeout is 0, the server never times out. It waits for all active requests to finish.
+func RunTLSConfig(addr string, cfg *tls.Config, timeout time.Duration, n http.Handler) error {
+	srv := &Server{
+		Timeout: timeout,
+		Server:  &http.Server{Addr: addr, Handler: n},
+	}
+
+	return srv.ListenAndServeTLSConfig(cfg)
+}
+
+// ServeContext is equivalent to RunErr, but also shuts down gracefully when
+// ctx is done. Signals are still handled, so either may initiate the shutdown.
+// If the shutdown was caused by ctx, ctx.Err() is returned. ctx also bounds
+// creating the listener, for instance resolving the host in addr; if it is
+// done before the listener is created, ctx.Err() is returned wrapped with
+// addr.
+//
+// timeout is the duration to wait until killing active requests and stopping the server.
+// If timeout is 0, the server never times out. It waits for all active requests to finish.
+func ServeContext(ctx context.Context, addr string, timeout time.Duration, n http.Handler) error {
+	srv := &Server{
+		Timeout: timeout,
+		Server:  &http.Server{Addr: addr, Handler: n},
+	}
+
+	err := srv.serveContext(ctx)
+	if ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ServeFunc returns a function which calls ListenAndServe and shuts the
+// server down gracefully, within Timeout, once ctx is done. It is meant to be
+// passed to errgroup.Group.Go, using the context returned by
+// errgroup.WithContext, so that the server stops when another member of the
+// group fails, and an error from the server cancels the rest of the group. A
+// shutdown caused by ctx returns nil unless connections had to be closed.
+// So does one caused by a signal, which does not stop the rest of the group;
+// set NoSignalHandling and derive ctx from signal.NotifyContext instead for
+// signals to stop the whole group.
+//
+// Example:
+//	g, ctx := errgroup.WithContext(ctx)
+//	g.Go(srv.ServeFunc(ctx))
+//	g.Go(func() error { return worker.Run(ctx) })
+//	err := g.Wait()
+func (srv *Server) ServeFunc(ctx context.Context) func() error {
+	return func() error {
+		return srv.serveContext(ctx)
+	}
+}
+
+// serveContext calls ListenAndServe, with ctx bounding the listen, and stops
+// the server once ctx is done.
+func (srv *Server) serveContext(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	go srv.labeled("context-watcher", func() {
+		select {
+		case <-ctx.Done():
+			srv.Stop(srv.Timeout)
+		case <-done:
 		}
+	})
+
+	return srv.listenAndServe(ctx)
+}
+
+// ServeWithSignalChan is equivalent to RunErr, but shuts down gracefully when
+// a signal is sent on c instead of when the process receives one. As with
+// OS signals, a second signal while draining closes the remaining connections
+// immediately. This allows tests to exercise the whole shutdown path without
+// signalling the test process. c is never closed by graceful.
+//
+// timeout is the duration to wait until killing active requests and stopping the server.
+// If timeout is 0, the server never times out. It waits for all active requests to finish.
+func ServeWithSignalChan(addr string, timeout time.Duration, n http.Handler, c chan os.Signal) error {
+	srv := &Server{
+		Timeout:          timeout,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: addr, Handler: n},
+		interrupt:        c,
+		callerInterrupt:  true,
 	}
+
+	return srv.ListenAndServe()
 }
 
 // ListenAndServe is equivalent to http.Server.ListenAndServe with graceful shutdown enabled.
 //
+// The server is used as configured, so settings such as ReadTimeout, WriteTimeout,
+// MaxHeaderBytes and ErrorLog apply as usual. Any ConnState callback already
+// set on server is preserved and called for every state change.
+//
 // timeout is the duration to wait until killing active requests and stopping the server.
 // If timeout is 0, the server never times out. It waits for all active requests to finish.
 func ListenAndServe(server *http.Server, timeout time.Duration) error {
@@ -94,15 +925,24 @@ func ListenAndServe(server *http.Server, timeout time.Duration) error {
 
 // ListenAndServe is equivalent to http.Server.ListenAndServe with graceful shutdown enabled.
 func (srv *Server) ListenAndServe() error {
+	return srv.listenAndServe(context.Background())
+}
+
+// listenAndServe implements ListenAndServe, with ctx bounding the listen.
+func (srv *Server) listenAndServe(ctx context.Context) error {
 	// Create the listener so we can control their lifetime
 	addr := srv.Addr
 	if addr == "" {
 		addr = ":http"
 	}
-	l, err := net.Listen("tcp", addr)
+	if srv.stopped() {
+		return ErrServerStopped
+	}
+	l, err := srv.listen(ctx, addr)
 	if err != nil {
 		return err
 	}
+	defer srv.removeSocket(addr)
 
 	if srv.ListenLimit != 0 {
 		l = netutil.LimitListener(l, srv.ListenLimit)
@@ -132,7 +972,11 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 		*config = *srv.TLSConfig
 	}
 	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
+		if srv.offersHTTP2() {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		} else {
+			config.NextProtos = []string{"http/1.1"}
+		}
 	}
 
 	var err error
@@ -142,10 +986,14 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 		return err
 	}
 
-	conn, err := net.Listen("tcp", addr)
+	if srv.stopped() {
+		return ErrServerStopped
+	}
+	conn, err := srv.listen(context.Background(), addr)
 	if err != nil {
 		return err
 	}
+	defer srv.removeSocket(addr)
 
 	tlsListener := tls.NewListener(conn, config)
 	return srv.Serve(tlsListener)
@@ -159,10 +1007,14 @@ func (srv *Server) ListenAndServeTLSConfig(config *tls.Config) error {
 		addr = ":https"
 	}
 
-	conn, err := net.Listen("tcp", addr)
+	if srv.stopped() {
+		return ErrServerStopped
+	}
+	conn, err := srv.listen(context.Background(), addr)
 	if err != nil {
 		return err
 	}
+	defer srv.removeSocket(addr)
 
 	tlsListener := tls.NewListener(conn, config)
 	return srv.Serve(tlsListener)
@@ -177,58 +1029,530 @@ func Serve(server *http.Server, l net.Listener, timeout time.Duration) error {
 	return srv.Serve(l)
 }
 
+// ServeListener serves the http.Handler on an already open listener with
+// graceful shutdown enabled. This is useful when the listening socket is
+// inherited from elsewhere, for example through systemd socket activation.
+//
+// timeout is the duration to wait until killing active requests and stopping the server.
+// If timeout is 0, the server never times out. It waits for all active requests to finish.
+func ServeListener(l net.Listener, timeout time.Duration, n http.Handler) error {
+	srv := &Server{Timeout: timeout, Server: &http.Server{Handler: n}}
+	return srv.Serve(l)
+}
+
 // Serve is equivalent to http.Server.Serve with graceful shutdown enabled.
+// It returns nil once the server has been shut down by a signal or Stop,
+// ErrDrainTimeout if connections had to be closed to do so, and the error
+// from http.Server.Serve if it failed for any other reason.
+//
+// The connections managed are those returned by listener, so a wrapping
+// listener, such as one decoding the PROXY protocol, determines the
+// connections and remote addresses seen by ConnState and the shutdown logs.
 func (srv *Server) Serve(listener net.Listener) error {
-	// Track connection state
-	add := make(chan net.Conn)
-	remove := make(chan net.Conn)
+	return srv.ServeListeners(listener)
+}
+
+// ServeListeners is equivalent to Serve, but serves on all of listeners at
+// once. Connections from every listener are managed together, so shutting
+// down closes all the listeners and then drains all of their connections
+// within the same timeout. If any listener stops serving, the others are
+// closed too, and the error from the first one to stop is returned.
+//
+// Listeners wrapped with ImmediateClose have their connections closed as
+// soon as the shutdown begins instead, so that they do not hold up the
+// drain of the others.
+func (srv *Server) ServeListeners(listeners ...net.Listener) error {
+	if len(listeners) == 0 {
+		return errors.New("graceful: no listeners to serve")
+	}
+	if srv.stopped() {
+		for _, l := range listeners {
+			_ = l.Close() // they will never be served. ignore error.
+		}
+		return ErrServerStopped
+	}
+	srv.reset()
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		addrs[i] = l.Addr().String()
+		if il, ok := l.(immediateListener); ok {
+			l = il.Listener
+		}
+		if ul, ok := l.(*net.UnixListener); ok && !srv.unlinkOnShutdown(true) {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	srv.stopLock.Lock()
+	srv.serving = strings.Join(addrs, ",")
+	srv.initiated = time.Time{}
+	srv.closing = time.Time{}
+	srv.deadline = time.Time{}
+	srv.drainUntil = time.Time{}
+	srv.stopLock.Unlock()
+	if err := srv.configureH2C(); err != nil {
+		return err
+	}
+
+	// Preserve a ConnState callback set on the http.Server itself. It is
+	// only captured once, so serving again does not wrap our own callback.
+	if !srv.connStateInstalled {
+		srv.serverConnState = srv.Server.ConnState
+		srv.connStateInstalled = true
+	}
 
 	srv.Server.ConnState = func(conn net.Conn, state http.ConnState) {
-		switch state {
-		case http.StateNew:
-			add <- conn
-		case http.StateClosed, http.StateHijacked:
-			remove <- conn
+		if srv.serverConnState != nil {
+			srv.callHook("ConnState", func() { srv.serverConnState(conn, state) })
 		}
 		if srv.ConnState != nil {
-			srv.ConnState(conn, state)
+			srv.callHook("ConnState", func() { srv.ConnState(conn, state) })
+		}
+		if !srv.NoConnectionTracking && !srv.trackImmediate(conn, state) {
+			srv.trackConnection(conn, state)
 		}
 	}
 
-	// Manage open connections
-	shutdown := make(chan chan struct{})
-	kill := make(chan struct{})
-	go srv.manageConnections(add, remove, shutdown, kill)
+	// Dispatch requests through the reloadable handler, so that Reload can
+	// replace it while serving.
+	if !srv.handlerInstalled {
+		if srv.handler.Load() == nil {
+			srv.handler.Store(reloadable{srv.Server.Handler})
+		}
+		srv.Server.Handler = http.HandlerFunc(srv.serveHTTP)
+		srv.handlerInstalled = true
+	}
 
-	interrupt := srv.interruptChan()
+	if srv.CancelOnShutdown {
+		if !srv.baseContextInstalled {
+			srv.serverBaseContext = srv.Server.BaseContext
+			srv.baseContextInstalled = true
+		}
 
-	// Set up the interrupt handler
-	if !srv.NoSignalHandling {
-		signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		srv.stopLock.Lock()
+		srv.cancelRequests = cancel
+		srv.stopLock.Unlock()
+
+		srv.Server.BaseContext = func(l net.Listener) context.Context {
+			if srv.serverBaseContext == nil {
+				return ctx
+			}
+			base, cancelBase := context.WithCancel(srv.serverBaseContext(l))
+			go func() {
+				<-ctx.Done()
+				cancelBase()
+			}()
+			return base
+		}
 	}
 
-	go srv.handleInterrupt(interrupt, listener)
+	// Tag contexts with their connection, so that serveHTTP can tell which
+	// connections are serving writes or reading a request body, and the
+	// priority of their requests.
+	if srv.SafeRequestTimeout > 0 || srv.DrainReadTimeout > 0 || srv.RequestPriority != nil {
+		if !srv.connContextInstalled {
+			srv.serverConnContext = srv.Server.ConnContext
+			srv.connContextInstalled = true
+		}
 
-	// Serve with graceful listener.
-	// Execution blocks here until listener.Close() is called, above.
-	err := srv.Server.Serve(listener)
+		srv.Server.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+			if srv.serverConnContext != nil {
+				ctx = srv.serverConnContext(ctx, conn)
+			}
+			return context.WithValue(ctx, connContextKey{}, conn)
+		}
+	}
 
-	srv.shutdown(shutdown, kill)
+	// Manage open connections
+	srv.connLock.Lock()
+	srv.connections = map[net.Conn]connInfo{}
+	srv.hijacked = map[net.Conn]uint64{}
+	srv.immediate = map[net.Conn]struct{}{}
+	srv.skipped = nil
+	srv.drained = nil
+	srv.drainersDone = nil
+	srv.closeDrainers = nil
+	srv.connLock.Unlock()
 
-	return err
-}
+	// quit is closed once connections are no longer being drained.
+	quit := make(chan struct{})
 
-// Stop instructs the type to halt operations and close
-// the stop channel when it is finished.
-//
+	// force is closed when a second signal is received while draining, or
+	// the context passed to Shutdown is done.
+	force := make(chan struct{})
+	var forceOnce sync.Once
+	forceClose := func() { forceOnce.Do(func() { close(force) }) }
+	srv.stopLock.Lock()
+	srv.forceClose = forceClose
+	srv.stopLock.Unlock()
+
+	// timedOut is closed once Timeout has passed since the listeners were
+	// closed, rather than since they stopped serving, which may be later.
+	// drainTimeout is the Timeout the drain was given, once compressed to
+	// fit MaxShutdownTime; it is set once startTimeout has returned.
+	timedOut := make(chan struct{})
+	var timeoutOnce sync.Once
+	var drainTimeout time.Duration
+	startTimeout := func() {
+		timeoutOnce.Do(func() {
+			drainTimeout = srv.drainTimeout()
+			if drainTimeout != 0 {
+				srv.stopLock.Lock()
+				srv.drainUntil = time.Now().Add(drainTimeout)
+				srv.stopLock.Unlock()
+			}
+			if timeout := drainTimeout; timeout > 0 {
+				time.AfterFunc(timeout, func() { close(timedOut) })
+			} else if timeout < 0 {
+				close(timedOut)
+			}
+		})
+	}
+
+	interrupt := srv.interruptChan()
+
+	// Set up the interrupt handler
+	if !srv.NoSignalHandling {
+		signal.Notify(interrupt, srv.signals()...)
+	}
+
+	// closed is closed once handleInterrupt has closed the listeners.
+	closed := make(chan struct{})
+
+	// interrupted is closed once handleInterrupt has finished with the
+	// interrupt channel, so that serving again cannot reuse it.
+	interrupted := make(chan struct{})
+
+	// served is closed once the shutdown has finished, so that the signal
+	// watchers return even if serving stopped without a signal.
+	served := make(chan struct{})
+	go srv.labeled("signal-watcher", func() {
+		defer close(interrupted)
+		srv.handleInterrupt(interrupt, listeners, startTimeout, closed, quit, served, forceClose)
+	})
+
+	restarted := make(chan struct{})
+	if srv.RestartSignal != nil && !srv.NoSignalHandling {
+		go srv.labeled("restart-watcher", func() {
+			defer close(restarted)
+			srv.handleRestart(served)
+		})
+	} else {
+		close(restarted)
+	}
+
+	watched := make(chan struct{})
+	if srv.ShutdownFile != "" {
+		go srv.labeled("file-watcher", func() {
+			defer close(watched)
+			srv.watchShutdownFile(served)
+		})
+	} else {
+		close(watched)
+	}
+
+	srv.stopLock.Lock()
+	ready := srv.readyChan()
+	select {
+	case <-ready:
+		// already closed by an earlier call to Serve
+	default:
+		close(ready)
+	}
+	srv.stopLock.Unlock()
+
+	// Serve with graceful listeners.
+	// Execution blocks here until listener.Close() is called, above.
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		if il, ok := l.(immediateListener); ok {
+			l = immediateListener{il.Listener, srv}
+		}
+		if srv.RetryAccept != nil {
+			l = retryListener{l, srv}
+		}
+		go func(l net.Listener) {
+			errs <- srv.Server.Serve(l)
+		}(l)
+	}
+	// Once the listeners are closed, Serve is only waited for up to
+	// serveStopTimeout, so that a Serve call which fails to return cannot
+	// stall the shutdown, even when Timeout is 0. The drain begins as soon
+	// as the listeners are closed, while Serve is still being waited for,
+	// just as the timeout does.
+	var err error
+	var deadline <-chan time.Time
+	var drainStart time.Time
+	var connsDrained <-chan struct{}
+	stopping := false
+	for n := 0; n < len(listeners); {
+		select {
+		case serveErr := <-errs:
+			if n == 0 {
+				err = serveErr
+				// Whether the shutdown had begun when serving first
+				// stopped tells an error caused by closing the listeners
+				// from one which stopped the server while it was running.
+				srv.stopLock.RLock()
+				stopping = srv.stopping
+				srv.stopLock.RUnlock()
+				if !stopping {
+					srv.logger().Printf("serving stopped unexpectedly: %v", err)
+				}
+				for _, l := range listeners {
+					_ = l.Close() // most are already closed. ignore error.
+				}
+				if deadline == nil {
+					deadline = time.After(serveStopTimeout)
+				}
+			}
+			n++
+		case <-closed:
+			closed = nil
+			stopping = stopping || n == 0
+			deadline = time.After(serveStopTimeout)
+			drainStart, connsDrained = time.Now(), srv.drainConnections()
+		case <-deadline:
+			srv.logger().Printf("serving did not stop within %v of closing the listeners", serveStopTimeout)
+			n = len(listeners)
+		}
+	}
+
+	// start the timeout here if the listeners stopped without a signal
+	startTimeout()
+	drainErr := srv.shutdown(drainStart, connsDrained, drainTimeout, timedOut, force, quit, interrupted)
+	srv.removeListenerSockets(listeners)
+	close(served)
+	<-interrupted
+	<-restarted
+	<-watched
+
+	// Accepting fails once the listeners are closed for shutdown, which is
+	// not an error to the caller.
+	if opErr, ok := err.(*net.OpError); (ok && opErr.Op == "accept" || err == nil) && stopping {
+		return drainErr
+	}
+	return err
+}
+
+// ImmediateClose wraps l so that, when it is served by ServeListeners
+// alongside other listeners, the connections it accepts are closed as soon
+// as the shutdown begins, however they are being used, rather than drained.
+// This suits listeners whose clients reconnect on their own, such as an
+// admin listener used by internal tools, so that they do not hold up the
+// drain of the public listeners. Such connections are counted by
+// TotalConnections, but are otherwise not managed: they are not counted by
+// ActiveConnections, passed to Tracker or limited by MaxConnections. With
+// NoConnectionTracking set, they are left open like any other connection.
+//
+// Example:
+//	err := srv.ServeListeners(public, graceful.ImmediateClose(admin))
+func ImmediateClose(l net.Listener) net.Listener {
+	return immediateListener{Listener: l}
+}
+
+// immediateListener is the listener returned by ImmediateClose. ServeListeners
+// sets srv, so that the connections it accepts are recorded as immediate.
+type immediateListener struct {
+	net.Listener
+	srv *Server
+}
+
+// Accept returns the next connection, recorded as immediate unless
+// NoConnectionTracking is set, as nothing would then forget it again.
+// Connections accepted once draining has begun are closed, and the next one
+// is waited for.
+func (l immediateListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.srv == nil || l.srv.NoConnectionTracking {
+			return conn, err
+		}
+
+		l.srv.connLock.Lock()
+		late := l.srv.immediate == nil || l.srv.drained != nil
+		if !late {
+			l.srv.immediate[conn] = struct{}{}
+		}
+		l.srv.connLock.Unlock()
+		if !late {
+			return conn, nil
+		}
+		_ = conn.Close() // it was accepted too late to be served
+	}
+}
+
+// trackImmediate reports whether conn was accepted from a listener wrapped
+// with ImmediateClose, forgetting it once it is closed or hijacked.
+func (srv *Server) trackImmediate(conn net.Conn, state http.ConnState) bool {
+	srv.connLock.Lock()
+	_, ok := srv.immediate[conn]
+	if ok && (state == http.StateClosed || state == http.StateHijacked) {
+		delete(srv.immediate, conn)
+	}
+	srv.connLock.Unlock()
+
+	if ok && state == http.StateNew {
+		atomic.AddUint64(&srv.totalConnections, 1)
+	}
+	return ok
+}
+
+// retryListener retries failed calls to Accept for as long as the server's
+// RetryAccept callback asks it to.
+type retryListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (l retryListener) Accept() (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err == nil || l.srv.stopped() || !l.srv.retryAccept(err) {
+			return conn, err
+		}
+
+		if delay == 0 {
+			delay = 5 * time.Millisecond
+		} else if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+		l.srv.logger().Printf("accept error: %v; retrying in %v", err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// retryAccept reports whether RetryAccept asks for err to be retried. A
+// panicking RetryAccept does not retry it.
+func (srv *Server) retryAccept(err error) bool {
+	retry := false
+	srv.callHook("RetryAccept", func() { retry = srv.RetryAccept(err) })
+	return retry
+}
+
+// Stop instructs the type to halt operations and close
+// the stop channel when it is finished.
+//
 // timeout is grace period for which to wait before shutting
 // down the server. The timeout value passed here will override the
 // timeout given when constructing the server, as this is an explicit
 // command to stop the server.
+//
+// Calling Stop more than once, or after a shutdown has already been
+// initiated by a signal, has no effect.
 func (srv *Server) Stop(timeout time.Duration) {
+	srv.stopLock.Lock()
+	defer srv.stopLock.Unlock()
+
+	if srv.stopping {
+		return
+	}
 	srv.Timeout = timeout
-	interrupt := srv.interruptChan()
-	interrupt <- syscall.SIGINT
+	srv.initiateStop()
+}
+
+// initiateStop initiates a shutdown, as a signal would. It must be called
+// with stopLock held.
+func (srv *Server) initiateStop() {
+	srv.stopping = true
+	if srv.interrupt == nil {
+		srv.interrupt = make(chan os.Signal, 1)
+	}
+	select {
+	case srv.interrupt <- os.Interrupt:
+	default:
+		// a signal is already pending and will initiate the shutdown
+	}
+}
+
+// Shutdown stops the server as Stop does, unless it is already stopping, and
+// waits for its connections to drain. If ctx is done first, the remaining
+// connections are closed and ctx.Err() is returned once the server has
+// stopped. Otherwise it returns nil. The deadline of ctx bounds the drain in
+// place of Timeout, which is left unchanged, as in http.Server.Shutdown,
+// which it replaces. On a server which has never been served it returns nil
+// at once, and the server is stopped as soon as it is.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	stopped := srv.StopChan()
+	srv.stopLock.Lock()
+	if !srv.stopping {
+		srv.unbounded = true
+		srv.initiateStop()
+	}
+	served := srv.serving != ""
+	srv.stopLock.Unlock()
+	if !served {
+		return nil
+	}
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+	}
+
+	srv.stopLock.RLock()
+	forceClose := srv.forceClose
+	srv.stopLock.RUnlock()
+	if forceClose != nil {
+		forceClose()
+		<-stopped
+	}
+	return ctx.Err()
+}
+
+// stopped reports whether a shutdown has been initiated which has not yet
+// completed. A Stop racing with the start of serving is not lost, as the
+// signal it sends is handled as soon as serving begins.
+func (srv *Server) stopped() bool {
+	srv.stopLock.RLock()
+	defer srv.stopLock.RUnlock()
+	return srv.stopping && !srv.finished
+}
+
+// reset prepares a server whose shutdown has completed to serve again. The
+// stop and shutting down channels of the previous run stay closed, and new
+// ones are created for this run; keep-alives, which were disabled by the
+// shutdown, are enabled again.
+func (srv *Server) reset() {
+	srv.stopLock.Lock()
+	defer srv.stopLock.Unlock()
+	if !srv.finished {
+		return
+	}
+	srv.finished = false
+	srv.stopping = false
+	srv.unbounded = false
+	srv.stopChan = nil
+	srv.shuttingDown = nil
+	srv.cancelRequests = nil
+	srv.SetKeepAlivesEnabled(true)
+}
+
+// Events returns a channel on which each step of a shutdown is sent as an
+// Event, as it is reported to OnShutdownEvent, so that logging, metrics and
+// coordination can all be driven by a single loop selecting on it. Every
+// call returns the same channel, which is never closed, and carries the
+// events of every shutdown of the server from the first call on. Sends
+// never block the shutdown: the channel buffers the events not yet
+// received, and further events are dropped while it is full.
+//
+// Example:
+//	events := srv.Events()
+//	go func() {
+//		for e := range events {
+//			log.Printf("%s: %d connections", e.Kind, e.Connections)
+//		}
+//	}()
+func (srv *Server) Events() <-chan Event {
+	srv.stopLock.Lock()
+	defer srv.stopLock.Unlock()
+	if srv.events == nil {
+		srv.events = make(chan Event, eventBuffer)
+	}
+	return srv.events
 }
 
 // StopChan gets the stop channel which will block until
@@ -243,77 +1567,1962 @@ func (srv *Server) StopChan() <-chan struct{} {
 	return srv.stopChan
 }
 
-func (srv *Server) manageConnections(add, remove chan net.Conn, shutdown chan chan struct{}, kill chan struct{}) {
-	{
-		var done chan struct{}
-		srv.connections = map[net.Conn]struct{}{}
-		for {
-			select {
-			case conn := <-add:
-				srv.connections[conn] = struct{}{}
-			case conn := <-remove:
-				delete(srv.connections, conn)
-				if done != nil && len(srv.connections) == 0 {
-					done <- struct{}{}
-					return
-				}
-			case done = <-shutdown:
-				if len(srv.connections) == 0 {
-					done <- struct{}{}
-					return
-				}
-			case <-kill:
-				for k := range srv.connections {
-					_ = k.Close() // nothing to do here if it errors
-				}
-				return
+// Wait blocks until the server has stopped, once its connections have all
+// finished or been closed and StopChan has been closed. It is equivalent to
+// receiving from StopChan, and is typically used after starting the server in
+// a goroutine:
+//
+//	go srv.ListenAndServe()
+//	// ...
+//	srv.Stop(10 * time.Second)
+//	srv.Wait()
+func (srv *Server) Wait() {
+	<-srv.StopChan()
+}
+
+// ActiveConnections returns the number of connections currently managed by
+// the server, including idle keep-alive connections. It is safe to call
+// concurrently, and returns 0 when the server is not serving.
+func (srv *Server) ActiveConnections() int {
+	srv.connLock.Lock()
+	defer srv.connLock.Unlock()
+	return len(srv.connections)
+}
+
+// TotalConnections returns the number of connections accepted over the
+// server's lifetime, including those closed for exceeding MaxConnections and
+// those accepted by earlier calls to Serve. Together with ActiveConnections
+// it gives the rate of connection churn. It is safe to call concurrently.
+func (srv *Server) TotalConnections() uint64 {
+	return atomic.LoadUint64(&srv.totalConnections)
+}
+
+// KilledConnections returns the number of connections closed forcefully over
+// the server's lifetime, because the timeout expired or a second signal was
+// received while draining. It is safe to call concurrently.
+func (srv *Server) KilledConnections() uint64 {
+	return atomic.LoadUint64(&srv.killedConnections)
+}
+
+// LastShutdown returns the statistics of the server's most recently
+// completed shutdown, as passed to ShutdownReported, and whether it has
+// completed a shutdown at all. It is safe to call concurrently.
+func (srv *Server) LastShutdown() (stats ShutdownStats, ok bool) {
+	srv.stopLock.RLock()
+	defer srv.stopLock.RUnlock()
+	return srv.lastShutdown, srv.shutDown
+}
+
+// DrainPreview describes what a shutdown initiated now would have to drain,
+// as returned by Server.DrainPreview.
+type DrainPreview struct {
+	// Timeout is the timeout the shutdown would be given.
+	Timeout time.Duration
+
+	// Connections holds the connections currently managed, in order of
+	// ID. Active is how long each active connection has been serving its
+	// current request.
+	Connections []ConnInfo
+
+	// AtRisk holds the active connections likely to still be serving their
+	// request once Timeout expires, and so to be closed by it. A connection
+	// is at risk when at least half the recent requests which took longer
+	// than its request so far went on for more than Timeout beyond that,
+	// or when no recent request took as long. With a Timeout of 0 none are
+	// at risk, and with a negative one every active connection is.
+	AtRisk []ConnInfo
+
+	// RecentRequests is the number of recently completed requests the
+	// estimate is based on. With none, no connection is reported at risk
+	// other than with a negative Timeout.
+	RecentRequests int
+}
+
+// DrainPreview reports what a shutdown initiated now, with the server's
+// Timeout, would have to drain, without initiating it: the connections
+// which would be waited for, how long each has been active, and which are
+// likely to be closed when the timeout expires, judging by how long the
+// last requests served took. It is meant for choosing a Timeout, for
+// instance in a canary, and is safe to call concurrently while serving.
+func (srv *Server) DrainPreview() DrainPreview {
+	preview := DrainPreview{Timeout: srv.Timeout}
+	now := time.Now()
+	srv.connLock.Lock()
+	for conn, info := range srv.connections {
+		c := ConnInfo{ID: info.id, RemoteAddr: conn.RemoteAddr(), State: info.state}
+		if info.state == http.StateActive {
+			c.Active = now.Sub(info.active)
+		}
+		preview.Connections = append(preview.Connections, c)
+	}
+	srv.connLock.Unlock()
+	sort.Slice(preview.Connections, func(i, j int) bool { return preview.Connections[i].ID < preview.Connections[j].ID })
+
+	durations := srv.recentDurations()
+	preview.RecentRequests = len(durations)
+
+	for _, c := range preview.Connections {
+		if c.State != http.StateActive {
+			continue
+		}
+		if preview.Timeout < 0 || preview.Timeout > 0 && atRisk(durations, c.Active, preview.Timeout) {
+			preview.AtRisk = append(preview.AtRisk, c)
+		}
+	}
+	return preview
+}
+
+// atRisk reports whether a request which has been served for age is likely
+// to take more than timeout longer, going by the durations of recent
+// requests.
+func atRisk(durations []time.Duration, age, timeout time.Duration) bool {
+	if len(durations) == 0 {
+		return false
+	}
+	longer, overrun := 0, 0
+	for _, d := range durations {
+		if d > age {
+			longer++
+			if d > age+timeout {
+				overrun++
 			}
 		}
 	}
+	return longer == 0 || 2*overrun >= longer
 }
 
-func (srv *Server) interruptChan() chan os.Signal {
-	srv.stopLock.Lock()
-	if srv.interrupt == nil {
-		srv.interrupt = make(chan os.Signal, 1)
+// recordDuration records how long a request took to serve, for DrainPreview.
+func (srv *Server) recordDuration(d time.Duration) {
+	n := atomic.AddUint64(&srv.requests, 1)
+	atomic.StoreInt64(&srv.durations[(n-1)%recentRequests], int64(d))
+}
+
+// recentDurations returns the durations recorded by recordDuration. A
+// request still being recorded may show the duration it replaces, or 0 if
+// its slot was empty, which is close enough for an estimate.
+func (srv *Server) recentDurations() []time.Duration {
+	n := atomic.LoadUint64(&srv.requests)
+	if n > recentRequests {
+		n = recentRequests
 	}
-	srv.stopLock.Unlock()
+	durations := make([]time.Duration, n)
+	for i := range durations {
+		durations[i] = time.Duration(atomic.LoadInt64(&srv.durations[i]))
+	}
+	return durations
+}
 
-	return srv.interrupt
+// Reload replaces the handler serving requests, for example with a new
+// routing table when the configuration is reloaded. Requests already being
+// served finish with the handler they started with, and new requests on
+// existing and new connections use n. It is safe to call while serving. Once
+// the server has been served, the Handler of the underlying http.Server
+// should not be changed directly.
+//
+// Example:
+//	reload := make(chan os.Signal, 1)
+//	signal.Notify(reload, syscall.SIGHUP)
+//	go func() {
+//		for range reload {
+//			srv.Reload(newMux())
+//		}
+//	}()
+func (srv *Server) Reload(n http.Handler) {
+	srv.handler.Store(reloadable{n})
 }
 
-func (srv *Server) handleInterrupt(interrupt chan os.Signal, listener net.Listener) {
-	<-interrupt
+// reloadable wraps the handler given to Reload, as an atomic.Value must
+// always hold the same concrete type.
+type reloadable struct {
+	handler http.Handler
+}
 
-	srv.SetKeepAlivesEnabled(false)
-	_ = listener.Close() // we are shutting down anyway. ignore error.
+// currentHandler returns the handler requests are dispatched to.
+func (srv *Server) currentHandler() http.Handler {
+	if r, ok := srv.handler.Load().(reloadable); ok {
+		return r.handler
+	}
+	return srv.Server.Handler
+}
 
-	if srv.ShutdownInitiated != nil {
-		srv.ShutdownInitiated()
+func (srv *Server) serveHTTP(rw http.ResponseWriter, r *http.Request) {
+	handler := srv.currentHandler()
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	start := time.Now()
+	if srv.CountRequests {
+		release := srv.Track()
+		defer release()
+	}
+	if (srv.KeepAliveTimeout > 0 || srv.KeepAliveMax > 0) && r.ProtoMajor == 1 {
+		if keepAlive := srv.keepAlive(); keepAlive != "" {
+			rw.Header().Set("Keep-Alive", keepAlive)
+		}
 	}
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		if srv.SafeRequestTimeout > 0 && !safeMethod(r.Method) {
+			srv.connLock.Lock()
+			if info, ok := srv.connections[conn]; ok {
+				info.writing = true
+				srv.connections[conn] = info
+			}
+			srv.connLock.Unlock()
+		}
+		if srv.DrainReadTimeout > 0 && r.Body != nil && r.Body != http.NoBody {
+			srv.startReading(conn)
+			r.Body = &drainBody{ReadCloser: r.Body, srv: srv, conn: conn}
+		}
+		if srv.RequestPriority != nil {
+			srv.prioritize(conn, r)
+		}
+	}
+	handler.ServeHTTP(rw, r)
+	srv.recordDuration(time.Since(start))
+}
 
-	signal.Stop(interrupt)
-	close(interrupt)
+// prioritize records the RequestPriority of r, served on conn, if it is
+// higher than that of the other requests the connection is serving.
+func (srv *Server) prioritize(conn net.Conn, r *http.Request) {
+	var priority int
+	srv.callHook("RequestPriority", func() { priority = srv.RequestPriority(r) })
+
+	srv.connLock.Lock()
+	defer srv.connLock.Unlock()
+	if info, ok := srv.connections[conn]; ok && (!info.prioritized || priority > info.priority) {
+		info.priority, info.prioritized = priority, true
+		srv.connections[conn] = info
+	}
 }
 
-func (srv *Server) shutdown(shutdown chan chan struct{}, kill chan struct{}) {
-	// Request done notification
-	done := make(chan struct{})
-	shutdown <- done
+// connContextKey is the context key of the connection a request is served
+// on, when SafeRequestTimeout, DrainReadTimeout or RequestPriority is set.
+type connContextKey struct{}
 
-	if srv.Timeout > 0 {
-		select {
-		case <-done:
-		case <-time.After(srv.Timeout):
-			close(kill)
+// drainBody is a request body which tells the server once it has been read
+// to the end, so that the connection is no longer limited by
+// DrainReadTimeout. A body closed early keeps the deadline, as the
+// http.Server may go on to read the rest of it.
+type drainBody struct {
+	io.ReadCloser
+	srv  *Server
+	conn net.Conn
+	once sync.Once
+}
+
+func (b *drainBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(func() { b.srv.finishReading(b.conn) })
+	}
+	return n, err
+}
+
+// startReading records that the body of a request on conn is being read,
+// setting a deadline of DrainReadTimeout at once if draining.
+func (srv *Server) startReading(conn net.Conn) {
+	srv.connLock.Lock()
+	defer srv.connLock.Unlock()
+	info, ok := srv.connections[conn]
+	if !ok {
+		return
+	}
+	info.reading = true
+	if srv.drained != nil {
+		srv.limitReading(conn, &info)
+	}
+	srv.connections[conn] = info
+}
+
+// finishReading records that the request body on conn has been read,
+// removing the deadline set by DrainReadTimeout, if any.
+func (srv *Server) finishReading(conn net.Conn) {
+	srv.connLock.Lock()
+	info, ok := srv.connections[conn]
+	limited := ok && info.readLimited
+	if ok {
+		info.reading, info.readLimited = false, false
+		srv.connections[conn] = info
+	}
+	srv.connLock.Unlock()
+
+	if limited {
+		_ = conn.SetReadDeadline(time.Time{}) // it may already be closed
+	}
+}
+
+// limitReading sets a read deadline of DrainReadTimeout on conn, described
+// by info. It must be called with connLock held.
+func (srv *Server) limitReading(conn net.Conn, info *connInfo) {
+	_ = conn.SetReadDeadline(time.Now().Add(srv.DrainReadTimeout))
+	info.readLimited = true
+}
+
+// keepAlive returns the Keep-Alive header advertising KeepAliveTimeout and
+// KeepAliveMax, tightened once shutdown is initiated, or "" once keep-alives
+// are disabled for the shutdown.
+func (srv *Server) keepAlive() string {
+	srv.stopLock.RLock()
+	initiated, closing := srv.initiated, srv.closing
+	srv.stopLock.RUnlock()
+
+	timeout, max := srv.KeepAliveTimeout, srv.KeepAliveMax
+	if !initiated.IsZero() && srv.DrainKeepAlives {
+		return ""
+	}
+	if !initiated.IsZero() && !closing.IsZero() {
+		left := time.Until(closing)
+		if left <= 0 {
+			return ""
+		}
+		if timeout == 0 || timeout > left {
+			timeout = left
+		}
+		if window := closing.Sub(initiated); max > 0 && window > 0 && left < window {
+			max = int((int64(max)*int64(left) + int64(window) - 1) / int64(window))
 		}
+	}
+
+	var params []string
+	if timeout > 0 {
+		seconds := int(timeout / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		params = append(params, fmt.Sprintf("timeout=%d", seconds))
+	}
+	if max > 0 {
+		params = append(params, fmt.Sprintf("max=%d", max))
+	}
+	return strings.Join(params, ", ")
+}
+
+// safeMethod reports whether method is a safe HTTP method, which should not
+// change the state of the server.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// HijackedConnections returns the number of hijacked connections, such as
+// WebSocket connections, which have not been released with ReleaseHijacked.
+func (srv *Server) HijackedConnections() int {
+	srv.connLock.Lock()
+	defer srv.connLock.Unlock()
+	return len(srv.hijacked)
+}
+
+// ConnectionID returns the ID of a managed or hijacked connection. IDs are
+// assigned in increasing order as connections are first seen, and appear in
+// the messages logged while draining, so a connection passed to ConnState or
+// OnHijackedShutdown can be correlated with them.
+func (srv *Server) ConnectionID(conn net.Conn) (id uint64, ok bool) {
+	srv.connLock.Lock()
+	defer srv.connLock.Unlock()
+	if info, ok := srv.connections[conn]; ok {
+		return info.id, true
+	}
+	id, ok = srv.hijacked[conn]
+	return id, ok
+}
+
+// ReleaseHijacked stops tracking a hijacked connection. Handlers should call
+// it once they have closed a connection they hijacked, as the http.Server
+// does not report when that happens.
+func (srv *Server) ReleaseHijacked(conn net.Conn) {
+	srv.connLock.Lock()
+	defer srv.connLock.Unlock()
+	delete(srv.hijacked, conn)
+}
+
+// TrackRequests wraps next so that every request it serves is counted, and
+// shutdown waits for those requests to return as well as for connections to
+// close. This covers requests which are not tied to a single connection, such
+// as handlers which hijack their connection, or HTTP/2 streams multiplexed
+// over one connection. Requests still running when the timeout expires are
+// not interrupted, but no longer delay the shutdown.
+//
+// Setting CountRequests has the same effect for every request the server
+// serves.
+//
+// Example:
+//	srv := &graceful.Server{Timeout: 10 * time.Second}
+//	srv.Server = &http.Server{Addr: ":1234", Handler: srv.TrackRequests(mux)}
+func (srv *Server) TrackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release := srv.Track()
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RejectDraining returns a handler which serves requests with next until the
+// server begins draining, once its listeners are closed, and from then on
+// replies to each new request with a 503 Service Unavailable and
+// "Connection: close", without calling next. Requests which reached next
+// before draining began are unaffected and complete normally. It keeps new
+// work from arriving on connections which are still open while they drain,
+// such as HTTP/2 connections or ones whose next request was already being
+// read. During ShutdownDelay requests are still served, as the server is
+// still reachable then.
+//
+// Example:
+//	srv := &graceful.Server{Timeout: 10 * time.Second}
+//	srv.Server = &http.Server{Addr: ":1234", Handler: srv.RejectDraining(mux)}
+func (srv *Server) RejectDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if srv.draining() {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "graceful: server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// draining reports whether the listeners have been closed by a shutdown
+// which is still in progress.
+func (srv *Server) draining() bool {
+	srv.stopLock.RLock()
+	closing := srv.closing
+	srv.stopLock.RUnlock()
+	return !closing.IsZero() && !time.Now().Before(closing)
+}
+
+// Track registers a task, such as background work started by a handler which
+// outlives its response, that shutdown waits for in the same way as requests
+// served through TrackRequests. The returned release function must be called
+// once the task has finished; calling it more than once has no effect.
+//
+// Example:
+//	release := srv.Track()
+//	go func() {
+//		defer release()
+//		writeAuditRecord(r)
+//	}()
+func (srv *Server) Track() (release func()) {
+	srv.connLock.Lock()
+	srv.tasks++
+	srv.connLock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			srv.connLock.Lock()
+			srv.tasks--
+			if srv.tasks == 0 && srv.tasksDone != nil {
+				close(srv.tasksDone)
+				srv.tasksDone = nil
+			}
+			srv.connLock.Unlock()
+		})
+	}
+}
+
+// waitTasks returns a channel which is closed once no tasks registered with
+// Track are left.
+func (srv *Server) waitTasks() <-chan struct{} {
+	srv.connLock.Lock()
+	defer srv.connLock.Unlock()
+
+	done := make(chan struct{})
+	if srv.tasks == 0 {
+		close(done)
 	} else {
-		<-done
+		srv.tasksDone = done
+	}
+	return done
+}
+
+// ListenerAddr returns the address the server is listening on, once
+// ListenAndServe, ListenAndServeTLS or ListenAndServeTLSConfig has created
+// its listener, or nil before then. This is useful to find the port chosen
+// by the operating system when listening on ":0".
+func (srv *Server) ListenerAddr() net.Addr {
+	srv.stopLock.RLock()
+	defer srv.stopLock.RUnlock()
+	if srv.listener == nil {
+		return nil
 	}
-	// Close the stopChan to wake up any blocked goroutines.
+	return srv.listener.Addr()
+}
+
+// Ready gets a channel which is closed once the listener has been created
+// and the server is about to accept connections on it. Clients started
+// after it is closed will not have their connections refused:
+//
+//	go srv.ListenAndServe()
+//	<-srv.Ready()
+//	http.Get("http://" + srv.ListenerAddr().String())
+func (srv *Server) Ready() <-chan struct{} {
 	srv.stopLock.Lock()
-	if srv.stopChan != nil {
-		close(srv.stopChan)
+	defer srv.stopLock.Unlock()
+	return srv.readyChan()
+}
+
+// readyChan must be called with stopLock held.
+func (srv *Server) readyChan() chan struct{} {
+	if srv.ready == nil {
+		srv.ready = make(chan struct{})
 	}
-	srv.stopLock.Unlock()
+	return srv.ready
+}
+
+// ShuttingDown gets a channel which is closed as soon as shutdown is
+// initiated, at the same moment ShutdownInitiated is called. Handlers may
+// select on it to finish long running requests early, for example:
+//
+//	mux.HandleFunc("/poll", func(w http.ResponseWriter, r *http.Request) {
+//		select {
+//		case msg := <-messages:
+//			fmt.Fprint(w, msg)
+//		case <-srv.ShuttingDown():
+//			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+//		}
+//	})
+func (srv *Server) ShuttingDown() <-chan struct{} {
+	srv.stopLock.Lock()
+	defer srv.stopLock.Unlock()
+	return srv.shuttingDownChan()
+}
+
+// DrainContext returns a context which is cancelled as soon as shutdown is
+// initiated, like the channel returned by ShuttingDown. Unlike the request
+// contexts cancelled by CancelOnShutdown, it is not tied to any request, so
+// background workers may watch it to wind down and flush their work while
+// connections drain, within Timeout. Once shutdown is initiated, its
+// Deadline reports when the drain will time out, if Timeout is set:
+//
+//	drain := srv.DrainContext()
+//	for {
+//		select {
+//		case job := <-jobs:
+//			batch.Add(job)
+//		case <-drain.Done():
+//			batch.Flush()
+//			return
+//		}
+//	}
+func (srv *Server) DrainContext() context.Context {
+	return drainContext{Context: context.Background(), srv: srv, done: srv.ShuttingDown()}
+}
+
+// drainContext is the context returned by DrainContext, which is done once
+// done is closed. It needs no goroutine to watch for the shutdown.
+type drainContext struct {
+	context.Context
+	srv  *Server
+	done <-chan struct{}
+}
+
+// Deadline reports no deadline until shutdown is initiated, and then when
+// the drain of srv times out.
+func (c drainContext) Deadline() (time.Time, bool) {
+	select {
+	case <-c.done:
+		return c.srv.drainDeadline()
+	default:
+		return time.Time{}, false
+	}
+}
+
+func (c drainContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c drainContext) Err() error {
+	select {
+	case <-c.done:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
+
+// IsShuttingDown reports whether shutdown has been initiated, from the
+// moment ShutdownInitiated is called until the server is next served. It is
+// convenient for health checks, for example to fail a readiness probe:
+//
+//	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+//		if srv.IsShuttingDown() {
+//			w.WriteHeader(http.StatusServiceUnavailable)
+//		}
+//	})
+func (srv *Server) IsShuttingDown() bool {
+	select {
+	case <-srv.ShuttingDown():
+		return true
+	default:
+		return false
+	}
+}
+
+// shuttingDownChan must be called with stopLock held.
+func (srv *Server) shuttingDownChan() chan struct{} {
+	if srv.shuttingDown == nil {
+		srv.shuttingDown = make(chan struct{})
+	}
+	return srv.shuttingDown
+}
+
+// trackConnection records the new state of conn. Once shutdown has begun,
+// active connections are limited by ConnectionTimeout.
+//
+// New connections, accepted but yet to send a request, are managed like
+// active ones: one accepted before the listener closed is drained rather
+// than closed, so that its first request is served. Only idle connections,
+// which have already been served, are closed when draining begins.
+func (srv *Server) trackConnection(conn net.Conn, state http.ConnState) {
+	if srv.Tracker != nil {
+		switch state {
+		case http.StateNew:
+			srv.callHook("Tracker.Add", func() { srv.Tracker.Add(conn) })
+		case http.StateClosed, http.StateHijacked:
+			srv.callHook("Tracker.Remove", func() { srv.Tracker.Remove(conn) })
+		}
+	}
+
+	skip := false
+	if state == http.StateActive && srv.SkipDrain != nil {
+		srv.callHook("SkipDrain", func() { skip = srv.SkipDrain(conn) })
+	}
+
+	if state == http.StateNew {
+		atomic.AddUint64(&srv.totalConnections, 1)
+	}
+
+	srv.connLock.Lock()
+	if srv.connections == nil {
+		// Connections are no longer being managed. One accepted as the
+		// listeners were closed, after the drain finished but before Serve
+		// returned, would otherwise be served unmanaged.
+		late := state == http.StateNew && srv.drained != nil
+		srv.connLock.Unlock()
+		if late {
+			_ = conn.Close() // nothing to do here if it errors
+		}
+		return
+	}
+
+	draining := srv.drained != nil
+	rejected, notify := false, false
+	switch state {
+	case http.StateNew:
+		if srv.MaxConnections > 0 && len(srv.connections) >= srv.MaxConnections {
+			rejected = true
+			break
+		}
+		srv.setState(conn, http.StateNew)
+		if draining && len(srv.connections) > srv.drainPeak {
+			srv.drainPeak = len(srv.connections)
+		}
+	case http.StateActive:
+		srv.setState(conn, http.StateActive)
+		srv.skipDrain(conn, skip)
+		if draining {
+			srv.limitConnection(conn)
+		}
+	case http.StateIdle:
+		srv.setState(conn, http.StateIdle)
+		srv.skipDrain(conn, false)
+		if info, ok := srv.connections[conn]; ok {
+			info.writing, info.reading, info.readLimited = false, false, false
+			info.priority, info.prioritized = 0, false
+			srv.connections[conn] = info
+		}
+	case http.StateClosed:
+		srv.removeConnection(conn)
+	case http.StateHijacked:
+		info, ok := srv.connections[conn]
+		srv.removeConnection(conn)
+		if ok && srv.hijacked != nil {
+			srv.hijacked[conn] = info.id
+			notify = draining
+		}
+	}
+	srv.connLock.Unlock()
+
+	if notify && srv.OnHijackedShutdown != nil {
+		go srv.callHook("OnHijackedShutdown", func() { srv.OnHijackedShutdown(conn) })
+	}
+
+	// Connections becoming idle during shutdown are not closed here. With
+	// keep-alives disabled the http.Server closes them itself once their
+	// response has been written, which for HTTP/2 may be after the last
+	// stream has been reported idle.
+	if rejected {
+		_ = conn.Close() // nothing to do here if it errors
+	}
+}
+
+// connInfo describes a managed connection.
+type connInfo struct {
+	id    uint64
+	state http.ConnState
+
+	// active is when the connection last became active.
+	active time.Time
+
+	// skip is set while SkipDrain reports the connection as not draining.
+	skip bool
+
+	// writing is set once the connection serves a request with a method
+	// which is not safe, until it becomes idle.
+	writing bool
+
+	// reading is set while a request body is being read from the
+	// connection, and readLimited once DrainReadTimeout applies to it.
+	reading     bool
+	readLimited bool
+
+	// priority is the highest RequestPriority of the requests served since
+	// the connection last became active, once prioritized is set.
+	priority    int
+	prioritized bool
+}
+
+// setState records the state of conn. A new connection is given the next
+// ID, and the keep-alive cycle between StateActive and StateIdle keeps it.
+// Only StateNew adds a connection, so one which is no longer managed, because
+// it was rejected, closed or hijacked, is not added back under a new ID by a
+// late transition. It must be called with connLock held.
+func (srv *Server) setState(conn net.Conn, state http.ConnState) {
+	info, ok := srv.connections[conn]
+	if !ok {
+		if state != http.StateNew {
+			return
+		}
+		srv.lastConnID++
+		info.id = srv.lastConnID
+	}
+	info.state = state
+	if state == http.StateActive {
+		info.active = time.Now()
+	}
+	srv.connections[conn] = info
+}
+
+// skipDrain records whether conn is skipped by the drain, closing drained
+// if only skipped connections are left. It must be called with connLock
+// held.
+func (srv *Server) skipDrain(conn net.Conn, skip bool) {
+	info, ok := srv.connections[conn]
+	if !ok || info.skip == skip {
+		return
+	}
+	info.skip = skip
+	srv.connections[conn] = info
+	if skip {
+		srv.checkDrained()
+	}
+}
+
+// removeConnection stops managing conn, and closes drained once the last
+// connection is gone. Removing a connection which is not managed, such as one
+// closed after being hijacked, has no effect. It must be called with
+// connLock held.
+func (srv *Server) removeConnection(conn net.Conn) {
+	if _, ok := srv.connections[conn]; !ok {
+		return
+	}
+	delete(srv.connections, conn)
+	srv.checkDrained()
+}
+
+// checkDrained closes drained and stops managing connections once only
+// connections skipped by the drain are left while draining, setting those
+// aside to be closed by closeSkipped. It must be called with connLock held.
+func (srv *Server) checkDrained() {
+	if srv.drained == nil || srv.connections == nil {
+		return
+	}
+	if srv.SkipDrain == nil && len(srv.connections) > 0 {
+		return
+	}
+	for _, info := range srv.connections {
+		if !info.skip {
+			return
+		}
+	}
+	for conn, info := range srv.connections {
+		if srv.skipped == nil {
+			srv.skipped = map[net.Conn]connInfo{}
+		}
+		srv.skipped[conn] = info
+	}
+	close(srv.drained)
+	srv.connections = nil
+}
+
+// closeSkipped closes the connections which were skipped by the drain.
+func (srv *Server) closeSkipped() {
+	srv.connLock.Lock()
+	skipped := srv.skipped
+	srv.skipped = nil
+	srv.connLock.Unlock()
+
+	for conn, info := range skipped {
+		srv.logger().Printf("closing skipped connection #%d from %s", info.id, conn.RemoteAddr())
+		_ = conn.Close() // nothing to do here if it errors
+	}
+}
+
+// drainConnections begins shutdown of the managed connections. Idle
+// connections are closed, so that only new and active connections are left
+// to drain, and the returned channel is closed once they have all finished.
+func (srv *Server) drainConnections() <-chan struct{} {
+	// SkipDrain is consulted again, without holding connLock, as a handler
+	// may have flagged its connection since it became active.
+	var skip []net.Conn
+	if srv.SkipDrain != nil {
+		srv.connLock.Lock()
+		var active []net.Conn
+		for conn, info := range srv.connections {
+			if info.state == http.StateActive && !info.skip {
+				active = append(active, conn)
+			}
+		}
+		srv.connLock.Unlock()
+		for _, conn := range active {
+			conn := conn
+			srv.callHook("SkipDrain", func() {
+				if srv.SkipDrain(conn) {
+					skip = append(skip, conn)
+				}
+			})
+		}
+	}
+
+	srv.connLock.Lock()
+	drained := make(chan struct{})
+	srv.drained = drained
+	srv.drainPeak = len(srv.connections)
+
+	var idle []net.Conn
+	for conn, info := range srv.connections {
+		if info.state == http.StateIdle {
+			idle = append(idle, conn)
+			continue
+		}
+		srv.limitConnection(conn)
+		if info.reading && srv.DrainReadTimeout > 0 {
+			srv.limitReading(conn, &info)
+			srv.connections[conn] = info
+		}
+	}
+	for _, conn := range skip {
+		if info, ok := srv.connections[conn]; ok && info.state == http.StateActive {
+			info.skip = true
+			srv.connections[conn] = info
+		}
+	}
+	srv.checkDrained()
+	if srv.SafeRequestTimeout > 0 {
+		time.AfterFunc(srv.SafeRequestTimeout, func() { srv.closeSafeConnections(drained) })
+	}
+	hijacked := make([]net.Conn, 0, len(srv.hijacked))
+	for conn := range srv.hijacked {
+		hijacked = append(hijacked, conn)
+	}
+	for conn := range srv.immediate {
+		idle = append(idle, conn)
+	}
+	srv.connLock.Unlock()
+
+	// Closed connections are removed once their state changes to StateClosed.
+	for _, conn := range idle {
+		_ = conn.Close() // nothing to do here if it errors
+	}
+	if srv.OnHijackedShutdown != nil {
+		for _, conn := range hijacked {
+			conn := conn
+			go srv.callHook("OnHijackedShutdown", func() { srv.OnHijackedShutdown(conn) })
+		}
+	}
+
+	done, closeDrainers := srv.shutdownDrainers()
+	srv.connLock.Lock()
+	srv.drainersDone = done
+	srv.closeDrainers = closeDrainers
+	srv.connLock.Unlock()
+	return drained
+}
+
+// closeSafeConnections closes the active connections which are not serving
+// writes, if the drain that closes drained is still running.
+func (srv *Server) closeSafeConnections(drained chan struct{}) {
+	srv.connLock.Lock()
+	if srv.drained != drained {
+		srv.connLock.Unlock()
+		return
+	}
+	safe := make(map[net.Conn]uint64)
+	for conn, info := range srv.connections {
+		if info.state == http.StateActive && !info.writing {
+			safe[conn] = info.id
+		}
+	}
+	srv.connLock.Unlock()
+
+	for conn, id := range safe {
+		srv.logger().Printf("closing connection #%d from %s serving safe requests", id, conn.RemoteAddr())
+		_ = conn.Close() // nothing to do here if it errors
+	}
+}
+
+// killRemaining closes the remaining connections, returning how many there
+// were and, unless the drain had nothing outstanding and no drainers had to
+// be closed, a DrainTimeoutError listing them.
+func (srv *Server) killRemaining(outstanding bool, drainersClosed int) (int, error) {
+	remaining := srv.killConnections()
+	if len(remaining) == 0 && !outstanding && drainersClosed == 0 {
+		return 0, nil
+	}
+	return len(remaining), &DrainTimeoutError{Remaining: remaining}
+}
+
+// killConnections closes all remaining connections, including hijacked
+// ones, unless ShouldKill spares them, and stops managing them, returning
+// those closed in order of ID.
+func (srv *Server) killConnections() []ConnInfo {
+	srv.connLock.Lock()
+	now := time.Now()
+	remaining := make(map[net.Conn]ConnInfo, len(srv.connections)+len(srv.hijacked)+len(srv.skipped))
+	record := func(conn net.Conn, info connInfo) {
+		left := ConnInfo{ID: info.id, RemoteAddr: conn.RemoteAddr(), State: info.state}
+		if info.state == http.StateActive {
+			left.Active = now.Sub(info.active)
+		}
+		remaining[conn] = left
+	}
+	for conn, info := range srv.connections {
+		record(conn, info)
+	}
+	for conn, id := range srv.hijacked {
+		record(conn, connInfo{id: id, state: http.StateHijacked})
+	}
+	for conn, info := range srv.skipped {
+		record(conn, info)
+	}
+	srv.connections = nil
+	srv.hijacked = nil
+	srv.skipped = nil
+	srv.connLock.Unlock()
+
+	for conn, left := range remaining {
+		// A panicking ShouldKill leaves the connection to be closed.
+		kill := true
+		if srv.ShouldKill != nil {
+			srv.callHook("ShouldKill", func() { kill = srv.ShouldKill(conn) })
+		}
+		if !kill {
+			srv.logger().Printf("leaving connection #%d from %s open", left.ID, conn.RemoteAddr())
+			delete(remaining, conn)
+			if srv.Tracker != nil {
+				srv.callHook("Tracker.Remove", func() { srv.Tracker.Remove(conn) })
+			}
+		}
+	}
+
+	if srv.Tracker != nil {
+		srv.callHook("Tracker.CloseAll", srv.Tracker.CloseAll)
+	}
+
+	srv.logger().Printf("closing %d connections", len(remaining))
+	closed := make([]ConnInfo, 0, len(remaining))
+	for conn, left := range remaining {
+		srv.logger().Printf("closing connection #%d from %s to %s", left.ID, conn.RemoteAddr(), conn.LocalAddr())
+		if srv.OnForceClose != nil {
+			conn := conn
+			_ = conn.SetWriteDeadline(time.Now().Add(forceCloseWriteTimeout))
+			srv.callHook("OnForceClose", func() { srv.OnForceClose(conn) })
+		}
+		_ = conn.Close() // nothing to do here if it errors
+		closed = append(closed, left)
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].ID < closed[j].ID })
+	return closed
+}
+
+// logDrainProgress logs the number of connections remaining every
+// DrainLogInterval until stop is closed.
+func (srv *Server) logDrainProgress(stop chan struct{}) {
+	ticker := time.NewTicker(srv.DrainLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			srv.logRemaining()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// logRemaining logs the number of connections remaining, and which they are.
+func (srv *Server) logRemaining() {
+	srv.connLock.Lock()
+	remaining := make(map[net.Conn]uint64, len(srv.connections))
+	for conn, info := range srv.connections {
+		remaining[conn] = info.id
+	}
+	srv.connLock.Unlock()
+
+	srv.logger().Printf("draining: %d connections remaining", len(remaining))
+	srv.shutdownEvent(EventConnectionsRemaining, len(remaining))
+	for conn, id := range remaining {
+		srv.logger().Printf("waiting on connection #%d from %s", id, conn.RemoteAddr())
+	}
+}
+
+// warnActive logs a warning, once each, for connections which have been
+// active for longer than WarnActiveAfter, checking every
+// activeCheckInterval until stop is closed.
+func (srv *Server) warnActive(stop chan struct{}) {
+	ticker := time.NewTicker(activeCheckInterval)
+	defer ticker.Stop()
+
+	warned := map[uint64]bool{}
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		type stuck struct {
+			id     uint64
+			remote net.Addr
+			active time.Duration
+		}
+		var conns []stuck
+		now := time.Now()
+		srv.connLock.Lock()
+		for conn, info := range srv.connections {
+			if info.state != http.StateActive || warned[info.id] {
+				continue
+			}
+			if active := now.Sub(info.active); active > srv.WarnActiveAfter {
+				conns = append(conns, stuck{info.id, conn.RemoteAddr(), active})
+				warned[info.id] = true
+			}
+		}
+		srv.connLock.Unlock()
+
+		for _, conn := range conns {
+			srv.logger().Printf("connection #%d from %s has been active for %v", conn.id, conn.remote, conn.active.Round(time.Millisecond))
+		}
+	}
+}
+
+// evictConnections waits until the last tenth of timeout, the drain's
+// Timeout, then closes the connections active for longer than EvictAge one
+// by one, oldest first and evenly spaced over the remaining time, until stop
+// is closed.
+func (srv *Server) evictConnections(timeout time.Duration, stop chan struct{}) {
+	window := timeout / 10
+	select {
+	case <-time.After(timeout - window):
+	case <-stop:
+		return
+	}
+
+	type oldConn struct {
+		conn net.Conn
+		info connInfo
+	}
+	var old []oldConn
+	srv.connLock.Lock()
+	for conn, info := range srv.connections {
+		if info.state == http.StateActive && time.Since(info.active) > srv.EvictAge {
+			old = append(old, oldConn{conn, info})
+		}
+	}
+	srv.connLock.Unlock()
+	sort.Slice(old, func(i, j int) bool { return old[i].info.active.Before(old[j].info.active) })
+
+	interval := window / time.Duration(len(old)+1)
+	for _, c := range old {
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+
+		// Skip connections which have finished or started another request
+		// since they were found.
+		srv.connLock.Lock()
+		info, ok := srv.connections[c.conn]
+		evict := ok && info.state == http.StateActive && info.active.Equal(c.info.active)
+		if evict {
+			srv.removeConnection(c.conn)
+		}
+		srv.connLock.Unlock()
+		if !evict {
+			continue
+		}
+
+		srv.logger().Printf("evicting connection #%d from %s, active for %v", c.info.id, c.conn.RemoteAddr(), time.Since(c.info.active))
+		_ = c.conn.Close() // nothing to do here if it errors
+	}
+}
+
+// closeLowPriority waits until the last tenth of timeout, the drain's
+// Timeout, then closes the active connections serving requests of a lower
+// RequestPriority than the highest, one by one, lowest priority and then
+// oldest first, and evenly spaced over the remaining time, until stop is
+// closed.
+func (srv *Server) closeLowPriority(timeout time.Duration, stop chan struct{}) {
+	window := timeout / 10
+	select {
+	case <-time.After(timeout - window):
+	case <-stop:
+		return
+	}
+
+	type lowConn struct {
+		conn net.Conn
+		info connInfo
+	}
+	var active []lowConn
+	highest := 0
+	srv.connLock.Lock()
+	for conn, info := range srv.connections {
+		if info.state != http.StateActive || !info.prioritized {
+			continue
+		}
+		if len(active) == 0 || info.priority > highest {
+			highest = info.priority
+		}
+		active = append(active, lowConn{conn, info})
+	}
+	srv.connLock.Unlock()
+
+	var low []lowConn
+	for _, c := range active {
+		if c.info.priority < highest {
+			low = append(low, c)
+		}
+	}
+	sort.Slice(low, func(i, j int) bool {
+		if low[i].info.priority != low[j].info.priority {
+			return low[i].info.priority < low[j].info.priority
+		}
+		return low[i].info.active.Before(low[j].info.active)
+	})
+
+	interval := window / time.Duration(len(low)+1)
+	for _, c := range low {
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+
+		// Skip connections which have finished or started another request
+		// since they were found.
+		srv.connLock.Lock()
+		info, ok := srv.connections[c.conn]
+		closing := ok && info.state == http.StateActive && info.active.Equal(c.info.active) && info.priority < highest
+		if closing {
+			srv.removeConnection(c.conn)
+		}
+		srv.connLock.Unlock()
+		if !closing {
+			continue
+		}
+
+		srv.logger().Printf("closing connection #%d from %s, serving priority %d below %d", c.info.id, c.conn.RemoteAddr(), info.priority, highest)
+		_ = c.conn.Close() // nothing to do here if it errors
+	}
+}
+
+// canComplete reports whether CanComplete allows the shutdown to complete,
+// which it does if it is nil or panics.
+func (srv *Server) canComplete() bool {
+	if srv.CanComplete == nil {
+		return true
+	}
+	complete := true
+	srv.callHook("CanComplete", func() { complete = srv.CanComplete() })
+	return complete
+}
+
+// extendDrain waits for the drain to finish for as long as ExtendDrain asks,
+// up to MaxDrainExtensions times, reporting whether it has finished.
+func (srv *Server) extendDrain(drained <-chan struct{}, force chan struct{}) bool {
+	if srv.ExtendDrain == nil {
+		return false
+	}
+	max := srv.MaxDrainExtensions
+	if max <= 0 {
+		max = defaultDrainExtensions
+	}
+
+	for i := 0; i < max; i++ {
+		remaining := srv.ActiveConnections()
+		var extension time.Duration
+		srv.callHook("ExtendDrain", func() { extension = srv.ExtendDrain(remaining) })
+		if extension <= 0 {
+			return false
+		}
+		srv.logger().Printf("extending drain by %v for %d connections", extension, remaining)
+
+		select {
+		case <-drained:
+			return true
+		case <-time.After(extension):
+		case <-force:
+			return false
+		}
+	}
+	return false
+}
+
+// waitKillGrace sets a deadline of KillGrace, scaled down to fit
+// MaxShutdownTime if need be, on the remaining connections, and reports
+// whether they all finish before it passes.
+func (srv *Server) waitKillGrace(drained <-chan struct{}, force chan struct{}) bool {
+	grace := srv.killGrace()
+	if grace <= 0 {
+		return false
+	}
+
+	deadline := time.Now().Add(grace)
+	srv.connLock.Lock()
+	for conn := range srv.connections {
+		_ = conn.SetDeadline(deadline)
+	}
+	srv.connLock.Unlock()
+
+	select {
+	case <-drained:
+		return true
+	case <-time.After(grace):
+	case <-force:
+	}
+	return false
+}
+
+// limitConnection closes conn once ConnectionTimeout has passed, if set.
+// The connection stops being managed as soon as it is closed, as its
+// handler may not return and report StateClosed until much later. It must
+// be called with connLock held.
+func (srv *Server) limitConnection(conn net.Conn) {
+	if srv.ConnectionTimeout <= 0 {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(srv.ConnectionTimeout))
+	time.AfterFunc(srv.ConnectionTimeout, func() {
+		_ = conn.Close() // it may already be closed
+		srv.connLock.Lock()
+		if srv.connections != nil {
+			srv.removeConnection(conn)
+		}
+		srv.connLock.Unlock()
+	})
+}
+
+// listen creates the listener for addr, or uses the listener inherited from
+// the parent process if this process was started by Restart and the
+// inherited listener is on addr. An error from
+// creating the listener is wrapped with addr, and may be unwrapped to the
+// *net.OpError to tell, for instance, a missing permission from an address
+// already in use. If ctx is done before the listener is created, ctx.Err()
+// is returned wrapped with addr instead.
+func (srv *Server) listen(ctx context.Context, addr string) (net.Listener, error) {
+	l, err := inheritedListener(srv.network(), addr)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		lc := srv.ListenConfig
+		if lc == nil {
+			lc = &net.ListenConfig{}
+		}
+		l, err = lc.Listen(ctx, srv.network(), addr)
+		if ctx.Err() != nil {
+			if err == nil {
+				_ = l.Close() // the listener was never used.
+			}
+			return nil, fmt.Errorf("graceful: failed to listen on %q: %w", addr, ctx.Err())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("graceful: failed to listen on %q: %w", addr, err)
+		}
+		if ul, ok := l.(*net.UnixListener); ok && !srv.unlinkOnShutdown(true) {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	srv.stopLock.Lock()
+	srv.listener = l
+	srv.handedOff = false
+	srv.stopLock.Unlock()
+	return l, nil
+}
+
+func (srv *Server) network() string {
+	if srv.Network == "" {
+		return "tcp"
+	}
+	return srv.Network
+}
+
+// removeSocket removes the socket file created for a unix socket listener,
+// which may already have been removed when the listener was closed.
+func (srv *Server) removeSocket(addr string) {
+	if srv.network() == "unix" && srv.unlinkOnShutdown(true) {
+		srv.unlinkSocket(addr)
+	}
+}
+
+// removeListenerSockets removes the socket files of the unix socket
+// listeners passed to ServeListeners, if UnlinkOnShutdown is set.
+func (srv *Server) removeListenerSockets(listeners []net.Listener) {
+	if !srv.unlinkOnShutdown(false) {
+		return
+	}
+	for _, l := range listeners {
+		if addr := l.Addr(); addr.Network() == "unix" {
+			srv.unlinkSocket(addr.String())
+		}
+	}
+}
+
+// unlinkOnShutdown reports whether unix socket files are to be removed on
+// shutdown, which is def unless UnlinkOnShutdown is set.
+func (srv *Server) unlinkOnShutdown(def bool) bool {
+	if srv.UnlinkOnShutdown == nil {
+		return def
+	}
+	return *srv.UnlinkOnShutdown
+}
+
+// unlinkSocket removes the socket file at path, unless the listener has
+// been handed off to a new process.
+func (srv *Server) unlinkSocket(path string) {
+	srv.stopLock.RLock()
+	handedOff := srv.handedOff
+	srv.stopLock.RUnlock()
+
+	if handedOff {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		srv.logger().Printf("failed to remove socket: %v", err)
+	}
+}
+
+// shutdownEvent reports event to OnShutdownEvent, if set, and sends it on
+// the channel returned by Events, if there is room.
+func (srv *Server) shutdownEvent(event ShutdownEvent, connections int) {
+	if srv.OnShutdownEvent != nil {
+		srv.callHook("OnShutdownEvent", func() { srv.OnShutdownEvent(event, connections) })
+	}
+
+	srv.stopLock.RLock()
+	events := srv.events
+	srv.stopLock.RUnlock()
+	if events != nil {
+		select {
+		case events <- Event{Kind: event, Connections: connections, Time: time.Now()}:
+		default:
+		}
+	}
+}
+
+// callHook calls the callback f, named name, logging rather than
+// propagating a panic, so that a failing callback cannot crash the server or
+// leave a shutdown unfinished.
+func (srv *Server) callHook(name string, f func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			srv.logger().Printf("panic in %s: %v", name, err)
+		}
+	}()
+	f()
+}
+
+// labeled runs f with the profiler labels "graceful", set to role, and
+// "addr", set to the addresses being served, so that the goroutines of each
+// server can be told apart in a goroutine profile.
+func (srv *Server) labeled(role string, f func()) {
+	srv.stopLock.RLock()
+	addr := srv.serving
+	srv.stopLock.RUnlock()
+	if addr == "" {
+		addr = srv.Addr
+	}
+	pprof.Do(context.Background(), pprof.Labels("graceful", role, "addr", addr), func(context.Context) { f() })
+}
+
+func (srv *Server) logger() *log.Logger {
+	if srv.Logger == nil {
+		return DefaultLogger()
+	}
+	return srv.Logger
+}
+
+func (srv *Server) signals() []os.Signal {
+	if len(srv.Signals) == 0 {
+		return defaultSignals
+	}
+	return srv.Signals
+}
+
+func (srv *Server) interruptChan() chan os.Signal {
+	srv.stopLock.Lock()
+	if srv.interrupt == nil {
+		srv.interrupt = make(chan os.Signal, 1)
+	}
+	srv.stopLock.Unlock()
+
+	return srv.interrupt
+}
+
+// shutdownDelay returns ShutdownDelay with a random part of ShutdownJitter
+// added.
+func (srv *Server) shutdownDelay() time.Duration {
+	if srv.ShutdownJitter <= 0 {
+		return srv.ShutdownDelay
+	}
+	var jitter int64
+	if srv.JitterSource != nil {
+		jitter = rand.New(srv.JitterSource).Int63n(int64(srv.ShutdownJitter))
+	} else {
+		jitter = rand.Int63n(int64(srv.ShutdownJitter))
+	}
+	return srv.ShutdownDelay + time.Duration(jitter)
+}
+
+// compressDelay returns delay and KillGrace, scaled down together if they
+// take longer than MaxShutdownTime.
+func (srv *Server) compressDelay(delay time.Duration) (time.Duration, time.Duration) {
+	grace := srv.KillGrace
+	fixed := delay + grace
+	if srv.MaxShutdownTime <= 0 || fixed <= srv.MaxShutdownTime {
+		return delay, grace
+	}
+	scale := float64(srv.MaxShutdownTime) / float64(fixed)
+	if delay > 0 {
+		compressed := time.Duration(float64(delay) * scale)
+		srv.logger().Printf("compressing shutdown delay from %v to %v to finish within %v", delay, compressed, srv.MaxShutdownTime)
+		delay = compressed
+	}
+	if grace > 0 {
+		compressed := time.Duration(float64(grace) * scale)
+		srv.logger().Printf("compressing kill grace from %v to %v to finish within %v", grace, compressed, srv.MaxShutdownTime)
+		grace = compressed
+	}
+	return delay, grace
+}
+
+// killGrace returns the KillGrace of the current shutdown, scaled down by
+// compressDelay if need be.
+func (srv *Server) killGrace() time.Duration {
+	srv.stopLock.RLock()
+	defer srv.stopLock.RUnlock()
+	if srv.closing.IsZero() {
+		return srv.KillGrace
+	}
+	return srv.scaledGrace
+}
+
+// drainDeadline returns when the drain of the current shutdown times out,
+// or is expected to once the ShutdownDelay is over if it has not started
+// yet, and false if it has no Timeout.
+func (srv *Server) drainDeadline() (time.Time, bool) {
+	srv.stopLock.RLock()
+	defer srv.stopLock.RUnlock()
+	if !srv.drainUntil.IsZero() {
+		return srv.drainUntil, true
+	}
+	timeout := srv.Timeout
+	if srv.unbounded {
+		timeout = 0
+	}
+	if timeout == 0 {
+		return time.Time{}, false
+	}
+	start := srv.closing
+	if start.IsZero() {
+		start = srv.initiated
+	}
+	until := start
+	if timeout > 0 {
+		until = start.Add(timeout)
+	}
+	grace := srv.KillGrace
+	if !srv.closing.IsZero() {
+		grace = srv.scaledGrace
+	}
+	if !srv.deadline.IsZero() && srv.deadline.Add(-grace).Before(until) {
+		until = srv.deadline.Add(-grace)
+	}
+	return until, true
+}
+
+// drainTimeout returns the Timeout to drain connections for, shortened so
+// that the drain and KillGrace finish before MaxShutdownTime has passed. A
+// negative duration means connections are not drained at all.
+func (srv *Server) drainTimeout() time.Duration {
+	srv.stopLock.RLock()
+	deadline := srv.deadline
+	srv.stopLock.RUnlock()
+	timeout := srv.timeout()
+	if deadline.IsZero() || timeout < 0 {
+		return timeout
+	}
+
+	// KillGrace, scaled down with the delay if need be, is left for after
+	// the drain.
+	left := time.Until(deadline) - srv.killGrace()
+	if timeout > 0 && timeout <= left {
+		return timeout
+	}
+	if left <= 0 {
+		srv.logger().Printf("compressing drain timeout from %v to 0s to finish within %v", timeout, srv.MaxShutdownTime)
+		return -1
+	}
+	srv.logger().Printf("compressing drain timeout from %v to %v to finish within %v", timeout, left, srv.MaxShutdownTime)
+	return left
+}
+
+// timeout returns the Timeout of the current shutdown, which is 0 if it was
+// initiated by Shutdown.
+func (srv *Server) timeout() time.Duration {
+	srv.stopLock.RLock()
+	defer srv.stopLock.RUnlock()
+	if srv.unbounded {
+		return 0
+	}
+	return srv.Timeout
+}
+
+func (srv *Server) handleInterrupt(interrupt chan os.Signal, listeners []net.Listener, startTimeout func(), closed, quit, served chan struct{}, forceClose func()) {
+	// signals is set to nil if the channel was closed by someone else, so
+	// that it is neither waited on nor closed again below.
+	signals := interrupt
+	select {
+	case _, ok := <-signals:
+		if !ok {
+			signals = nil
+		}
+	case <-served:
+		// Serving stopped and was drained without a signal. Stop
+		// notifications so that the registration does not outlive Serve;
+		// the channel is left for the next call to Serve, along with any
+		// Stop sent on it since.
+		signal.Stop(interrupt)
+		return
+	}
+
+	srv.stopLock.Lock()
+	srv.stopping = true
+	srv.initiated = time.Now()
+	if srv.MaxShutdownTime > 0 {
+		srv.deadline = srv.initiated.Add(srv.MaxShutdownTime)
+	}
+	close(srv.shuttingDownChan())
+	srv.stopLock.Unlock()
+
+	srv.logger().Printf("shutting down")
+
+	// ceiling fires once MaxShutdownTime has passed, closing the remaining
+	// connections as a second signal would.
+	var ceiling <-chan time.Time
+	if srv.MaxShutdownTime > 0 {
+		timer := time.NewTimer(srv.MaxShutdownTime)
+		defer timer.Stop()
+		ceiling = timer.C
+	}
+	srv.shutdownEvent(EventShutdownInitiated, srv.ActiveConnections())
+
+	// This is called before the listener is closed, so that it always
+	// precedes ShutdownCompleted.
+	if srv.ShutdownInitiated != nil {
+		srv.callHook("ShutdownInitiated", srv.ShutdownInitiated)
+	}
+
+	if srv.DrainKeepAlives {
+		srv.SetKeepAlivesEnabled(false)
+	}
+
+	// A second signal during the delay, or while draining, closes all
+	// connections immediately.
+	forced := false
+	delay, grace := srv.compressDelay(srv.shutdownDelay())
+	srv.stopLock.Lock()
+	srv.closing = time.Now().Add(delay)
+	srv.scaledGrace = grace
+	srv.stopLock.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-signals:
+			forced = true
+		}
+	}
+
+	srv.stopLock.Lock()
+	srv.closing = time.Now()
+	srv.stopLock.Unlock()
+	srv.SetKeepAlivesEnabled(false)
+	startTimeout()
+	for _, l := range listeners {
+		_ = l.Close() // we are shutting down anyway. ignore error.
+	}
+	if srv.OnListenerClosed != nil {
+		srv.callHook("OnListenerClosed", srv.OnListenerClosed)
+	}
+	close(closed)
+	srv.shutdownEvent(EventListenerClosed, srv.ActiveConnections())
+
+	srv.stopLock.RLock()
+	cancelRequests := srv.cancelRequests
+	srv.stopLock.RUnlock()
+	if cancelRequests != nil {
+		cancelRequests()
+	}
+
+	if !forced {
+		select {
+		case <-signals:
+			forced = true
+		case <-ceiling:
+			srv.logger().Printf("maximum shutdown time of %v reached", srv.MaxShutdownTime)
+			forceClose()
+		case <-quit:
+		}
+	}
+	if forced {
+		srv.logger().Printf("second signal received")
+		forceClose()
+	}
+
+	// Stop notifications before closing the channel, so that no signal can
+	// be delivered to it once closed. It is only closed once, and is no
+	// longer used for future calls to Stop or Serve.
+	signal.Stop(interrupt)
+	srv.stopLock.Lock()
+	if signals != nil && srv.interrupt == interrupt && !srv.callerInterrupt {
+		close(interrupt)
+	}
+	if srv.interrupt == interrupt {
+		srv.interrupt = nil
+	}
+	srv.stopLock.Unlock()
+}
+
+func (srv *Server) handleRestart(served chan struct{}) {
+	restart := make(chan os.Signal, 1)
+	signal.Notify(restart, srv.RestartSignal)
+	defer signal.Stop(restart)
+
+	select {
+	case <-restart:
+		if err := srv.Restart(); err != nil {
+			srv.logger().Printf("restart failed: %v", err)
+		}
+	case <-srv.ShuttingDown():
+	case <-served:
+	}
+}
+
+// watchShutdownFile polls ShutdownFile, stopping the server once the file is
+// created or changed, until the server shuts down or served is closed.
+func (srv *Server) watchShutdownFile(served chan struct{}) {
+	interval := srv.ShutdownFileInterval
+	if interval <= 0 {
+		interval = defaultShutdownFileInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// A file is told to have changed by its size and modification time,
+	// and a missing one by its zero state.
+	type fileState struct {
+		exists bool
+		size   int64
+		mod    time.Time
+	}
+	stat := func() fileState {
+		fi, err := os.Stat(srv.ShutdownFile)
+		if err != nil {
+			return fileState{}
+		}
+		return fileState{true, fi.Size(), fi.ModTime()}
+	}
+
+	last := stat()
+	for {
+		select {
+		case <-ticker.C:
+		case <-srv.ShuttingDown():
+			return
+		case <-served:
+			return
+		}
+
+		state := stat()
+		if state.exists != last.exists || state.size != last.size || !state.mod.Equal(last.mod) {
+			last = state
+			if state.exists {
+				srv.logger().Printf("shutdown requested by %s", srv.ShutdownFile)
+				srv.Stop(srv.Timeout)
+				return
+			}
+		}
+	}
+}
+
+// shutdown drains the managed connections, returning ErrDrainTimeout if any
+// had to be closed, or the error from closing the handler. The drain is
+// begun here unless connsDrained shows it began at start, when the listeners
+// were closed. drainTimeout is the Timeout the drain was given, after any
+// compression to fit MaxShutdownTime.
+func (srv *Server) shutdown(start time.Time, connsDrained <-chan struct{}, drainTimeout time.Duration, timedOut, force, quit, interrupted chan struct{}) error {
+	// A shutdown not initiated by handleInterrupt, because serving stopped
+	// on its own, is reported as initiated here, so that it is still the
+	// first event.
+	srv.stopLock.RLock()
+	reported := !srv.initiated.IsZero()
+	srv.stopLock.RUnlock()
+	if !reported {
+		srv.shutdownEvent(EventShutdownInitiated, srv.ActiveConnections())
+	}
+
+	if connsDrained == nil {
+		start, connsDrained = time.Now(), srv.drainConnections()
+	}
+
+	// Requests and tasks registered with TrackRequests and Track are waited
+	// for once no connections are left, as no new requests can start after
+	// that, and then for CanComplete to allow the shutdown to finish.
+	srv.connLock.Lock()
+	drainersDone, closeDrainers := srv.drainersDone, srv.closeDrainers
+	srv.connLock.Unlock()
+	// The tracker gives up once quit is closed, as the connections are
+	// then killed without closing connsDrained, and is waited for below
+	// so that it does not outlive the shutdown. blocked is closed the first
+	// time it has to wait for something, so that a timeout can tell
+	// whether the drain was held up or was merely about to finish.
+	drained, blocked, trackerDone := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	var blockOnce sync.Once
+	block := func() { blockOnce.Do(func() { close(blocked) }) }
+	wait := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+		}
+		block()
+		select {
+		case <-ch:
+			return true
+		case <-quit:
+			return false
+		}
+	}
+	go srv.labeled("connection-tracker", func() {
+		defer close(trackerDone)
+		if !wait(connsDrained) {
+			return
+		}
+		srv.closeSkipped()
+		if !wait(srv.waitTasks()) || !wait(drainersDone) {
+			return
+		}
+		if srv.WaitGroup != nil {
+			// The goroutine waiting on the WaitGroup is left behind if
+			// it is never done.
+			done := make(chan struct{})
+			go func() {
+				srv.WaitGroup.Wait()
+				close(done)
+			}()
+			if !wait(done) {
+				return
+			}
+		}
+		for !srv.canComplete() {
+			block()
+			select {
+			case <-time.After(canCompleteInterval):
+			case <-quit:
+				return
+			}
+		}
+		close(drained)
+	})
+
+	// outstanding reports whether the drain was still waiting on anything
+	// when it was cut short.
+	outstanding := func() bool {
+		select {
+		case <-drained:
+			return false
+		case <-blocked:
+			return true
+		}
+	}
+
+	// stopProgress stops logging drain progress, waiting for any message
+	// being logged.
+	stopProgress := func() {}
+	if srv.DrainLogInterval > 0 {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go srv.labeled("drain-logger", func() {
+			defer close(done)
+			srv.logDrainProgress(stop)
+		})
+		stopProgress = func() {
+			close(stop)
+			<-done
+		}
+	}
+
+	// stopWarning likewise stops warning about long-active connections.
+	stopWarning := func() {}
+	if srv.WarnActiveAfter > 0 {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go srv.labeled("active-watcher", func() {
+			defer close(done)
+			srv.warnActive(stop)
+		})
+		stopWarning = func() {
+			close(stop)
+			<-done
+		}
+	}
+
+	// stopEviction likewise stops evicting old connections.
+	stopEviction := func() {}
+	if srv.EvictAge > 0 && drainTimeout > 0 {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go srv.labeled("evictor", func() {
+			defer close(done)
+			srv.evictConnections(drainTimeout, stop)
+		})
+		stopEviction = func() {
+			close(stop)
+			<-done
+		}
+	}
+
+	// stopPriority likewise stops closing low-priority connections.
+	stopPriority := func() {}
+	if srv.RequestPriority != nil && drainTimeout > 0 {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go srv.labeled("prioritizer", func() {
+			defer close(done)
+			srv.closeLowPriority(drainTimeout, stop)
+		})
+		stopPriority = func() {
+			close(stop)
+			<-done
+		}
+	}
+
+	var err error
+	killed := 0
+	timeout := false
+	select {
+	case <-drained:
+		srv.logger().Printf("shutdown complete")
+	case <-timedOut:
+		srv.logger().Printf("timeout reached")
+		timeout = true
+		if srv.timeout() >= 0 && (srv.extendDrain(drained, force) || srv.waitKillGrace(drained, force)) {
+			srv.logger().Printf("shutdown complete")
+		} else {
+			// A negative Timeout expires before the drain has begun, so
+			// it only times out if the drain had anything outstanding.
+			killed, err = srv.killRemaining(outstanding(), closeDrainers())
+			timeout = err != nil
+		}
+	case <-force:
+		killed, err = srv.killRemaining(outstanding(), closeDrainers())
+	}
+	stopProgress()
+	stopWarning()
+	stopEviction()
+	stopPriority()
+	if err == nil {
+		srv.shutdownEvent(EventDrainComplete, 0)
+	} else {
+		srv.shutdownEvent(EventConnectionsKilled, killed)
+	}
+	close(quit)
+	<-trackerDone
+
+	// Once a shutdown was initiated, wait for the interrupt channel to be
+	// released. Otherwise nothing will be received on it, and it is left
+	// for the next call to Serve.
+	if srv.stopped() {
+		<-interrupted
+	}
+
+	if closer, ok := srv.currentHandler().(io.Closer); ok && srv.CloseHandler {
+		var closeErr error
+		srv.callHook("CloseHandler", func() { closeErr = closer.Close() })
+		if closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				srv.logger().Printf("closing handler failed: %v", closeErr)
+			}
+		}
+	}
+
+	if srv.ConnectionsKilled != nil {
+		srv.callHook("ConnectionsKilled", func() { srv.ConnectionsKilled(killed) })
+	}
+	srv.connLock.Lock()
+	peak := srv.drainPeak
+	srv.connLock.Unlock()
+	atomic.AddUint64(&srv.killedConnections, uint64(killed))
+
+	// A shutdown not initiated by handleInterrupt, because serving stopped
+	// on its own, is measured from the start of the drain.
+	srv.stopLock.Lock()
+	initiated := srv.initiated
+	if initiated.IsZero() || initiated.After(start) {
+		initiated = start
+	}
+	stats := ShutdownStats{
+		Drain:             time.Since(start),
+		Shutdown:          time.Since(initiated),
+		PeakConnections:   peak,
+		ConnectionsKilled: killed,
+		TimedOut:          timeout,
+	}
+	srv.lastShutdown = stats
+	srv.shutDown = true
+	srv.stopLock.Unlock()
+	if srv.ShutdownReported != nil {
+		srv.callHook("ShutdownReported", func() { srv.ShutdownReported(stats) })
+	}
+	if srv.ShutdownCompleted != nil {
+		srv.callHook("ShutdownCompleted", srv.ShutdownCompleted)
+	}
+
+	// Close the stopChan to wake up any blocked goroutines. It is created
+	// here if necessary so that StopChan never blocks once stopped. Ready
+	// blocks again until the server is next served.
+	srv.stopLock.Lock()
+	if srv.stopChan == nil {
+		srv.stopChan = make(chan struct{})
+	}
+	close(srv.stopChan)
+	srv.finished = true
+	srv.ready = nil
+	srv.stopLock.Unlock()
+
+	return err
 }
@@ -1,14 +1,35 @@
 package graceful
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/big"
+	mrand "math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"reflect"
+	"runtime/pprof"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -49,8 +70,12 @@ func checkErr(t *testing.T, err error, once *sync.Once) bool {
 	if err.(*url.Error).Err == io.EOF {
 		return true
 	}
-	errno := err.(*url.Error).Err.(*net.OpError).Err.(syscall.Errno)
-	if errno == syscall.ECONNREFUSED {
+	// The net package now wraps the errno in an *os.SyscallError.
+	opErr := err.(*url.Error).Err.(*net.OpError).Err
+	if sysErr, ok := opErr.(*os.SyscallError); ok {
+		opErr = sysErr.Err
+	}
+	if errno, ok := opErr.(syscall.Errno); ok && errno == syscall.ECONNREFUSED {
 		return true
 	} else if err != nil {
 		once.Do(func() {
@@ -75,6 +100,33 @@ func createListener(sleep time.Duration) (*http.Server, net.Listener, error) {
 	return server, l, err
 }
 
+// createLocalListener is like createListener, but listens on a port chosen
+// by the system, so that tests using it do not collide with each other.
+func createLocalListener(sleep time.Duration) (*http.Server, net.Listener, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(sleep)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	return &http.Server{Addr: l.Addr().String(), Handler: mux}, l, nil
+}
+
+// freeAddr returns a local address on a port chosen by the system, for the
+// functions which create their listener from an address.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
 func runServer(timeout, sleep time.Duration, c chan os.Signal) error {
 	server, l, err := createListener(sleep)
 	if err != nil {
@@ -86,6 +138,11 @@ func runServer(timeout, sleep time.Duration, c chan os.Signal) error {
 }
 
 func launchTestQueries(t *testing.T, wg *sync.WaitGroup, c chan os.Signal) {
+	// give the server a chance to start listening: runServer is started
+	// in a goroutine alongside this one, and queries made before it has
+	// listened fail with no response
+	time.Sleep(waitTime)
+
 	var once sync.Once
 	for i := 0; i < 8; i++ {
 		go runQuery(t, http.StatusOK, false, wg, &once)
@@ -279,6 +336,7 @@ func TestShutdownInitiatedCallback(t *testing.T) {
 	cb := func() { close(called) }
 
 	srv := &Server{Server: server, ShutdownInitiated: cb}
+	stopped := srv.StopChan()
 
 	go func() {
 		go srv.Serve(l)
@@ -291,6 +349,42 @@ func TestShutdownInitiatedCallback(t *testing.T) {
 	case <-time.After(killTime):
 		t.Fatal("Timed out while waiting for ShutdownInitiated callback to be called")
 	}
+
+	// the callback runs before the listener is closed
+	<-stopped
+}
+
+func TestOnListenerClosed(t *testing.T) {
+	var initiated time.Time
+	closed := make(chan time.Time, 1)
+	srv := &Server{
+		Timeout:           killTime,
+		ShutdownDelay:     waitTime,
+		NoSignalHandling:  true,
+		ShutdownInitiated: func() { initiated = time.Now() },
+		Server:            &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	srv.OnListenerClosed = func() {
+		if conn, err := net.Dial("tcp", srv.ListenerAddr().String()); err == nil {
+			conn.Close()
+			t.Error("Expected the listener to be closed when OnListenerClosed is called")
+		}
+		closed <- time.Now()
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	srv.Stop(killTime)
+	select {
+	case at := <-closed:
+		if d := at.Sub(initiated); d < waitTime {
+			t.Errorf("Expected OnListenerClosed to follow ShutdownInitiated by the %v delay. Got %v", waitTime, d)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for OnListenerClosed to be called")
+	}
+	<-stopped
 }
 func hijackingListener(srv *Server) (*http.Server, net.Listener, error) {
 	mux := http.NewServeMux()
@@ -377,3 +471,4579 @@ func TestStopDeadlock(t *testing.T) {
 		t.Fatal("Timed out while waiting for explicit stop to complete")
 	}
 }
+
+func TestShutdown(t *testing.T) {
+	srv := &Server{
+		NoSignalHandling: true,
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				time.Sleep(timeoutTime)
+			}),
+		},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTime)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v. Got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed >= killTime {
+		t.Errorf("Expected connections to be closed once the context was done. Took %v", elapsed)
+	}
+	if err := <-errc; !errors.Is(err, ErrDrainTimeout) {
+		t.Errorf("Expected %v from ListenAndServe. Got %v", ErrDrainTimeout, err)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	srv := &Server{
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutTime)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Expected a clean shutdown. Got %v", err)
+	}
+}
+
+func TestShutdownKeepsTimeout(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutTime)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Expected a clean shutdown. Got %v", err)
+	}
+	if srv.Timeout != killTime {
+		t.Errorf("Expected Shutdown to leave the Timeout of %v. Got %v", killTime, srv.Timeout)
+	}
+}
+
+func TestShutdownBeforeServe(t *testing.T) {
+	srv := &Server{
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), killTime)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Expected no error shutting down a server never served. Got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= waitTime {
+		t.Errorf("Expected Shutdown to return at once. Took %v", elapsed)
+	}
+	if err := srv.ListenAndServe(); err != ErrServerStopped {
+		t.Errorf("Expected %v. Got %v", ErrServerStopped, err)
+	}
+}
+
+func TestStopBeforeServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	srv := &Server{
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: addr, Handler: http.NewServeMux()},
+	}
+	srv.Stop(killTime)
+
+	if err := srv.ListenAndServe(); err != ErrServerStopped {
+		t.Fatalf("Expected %v. Got %v", ErrServerStopped, err)
+	}
+
+	// the address must never have been bound
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestServeAgainAfterShutdown(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+
+	for i := 0; i < 2; i++ {
+		errc := make(chan error, 1)
+		go func() { errc <- srv.ListenAndServe() }()
+		<-srv.Ready()
+		stopped := srv.StopChan()
+
+		r, err := http.Get("http://" + srv.ListenerAddr().String())
+		if err != nil {
+			t.Fatalf("Run %d: %v", i, err)
+		}
+		r.Body.Close()
+		if r.Close {
+			t.Errorf("Run %d: expected keep-alives to be enabled", i)
+		}
+
+		srv.Stop(killTime)
+		select {
+		case <-stopped:
+		case <-time.After(timeoutTime):
+			t.Fatalf("Run %d: timed out waiting for the server to stop", i)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("Run %d: expected a clean shutdown. Got %v", i, err)
+		}
+	}
+}
+
+func TestFatalHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var fatalErr error
+	defer func(f func(error)) { FatalHandler = f }(FatalHandler)
+	FatalHandler = func(err error) { fatalErr = err }
+
+	Run(l.Addr().String(), killTime, http.NewServeMux())
+	var opErr *net.OpError
+	if !errors.As(fatalErr, &opErr) || opErr.Op != "listen" {
+		t.Fatalf("Expected the listen error to be passed to FatalHandler. Got %v", fatalErr)
+	}
+}
+
+func TestServeReturnsAfterKillOrDrain(t *testing.T) {
+	srv := &Server{
+		NoSignalHandling: true,
+		Logger:           log.New(io.Discard, "", 0),
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					time.Sleep(timeoutTime)
+				}
+			}),
+		},
+	}
+
+	for i := 0; i < 6; i++ {
+		kill := i%2 == 1
+		errc := make(chan error, 1)
+		go func() { errc <- srv.ListenAndServe() }()
+		<-srv.Ready()
+
+		path := "/"
+		if kill {
+			path = "/slow"
+		}
+		addr := srv.ListenerAddr().String()
+		go func() {
+			if r, err := http.Get("http://" + addr + path); err == nil {
+				r.Body.Close()
+			}
+		}()
+		time.Sleep(waitTime / 2)
+
+		srv.Stop(waitTime)
+		select {
+		case err := <-errc:
+			if kill && !errors.Is(err, ErrDrainTimeout) || !kill && err != nil {
+				t.Errorf("Run %d: unexpected error %v", i, err)
+			}
+		case <-time.After(killTime):
+			t.Fatalf("Run %d: Serve did not return", i)
+		}
+
+		var profile bytes.Buffer
+		if err := pprof.Lookup("goroutine").WriteTo(&profile, 1); err != nil {
+			t.Fatal(err)
+		}
+		label := fmt.Sprintf("%q:%q", "addr", addr)
+		for _, line := range strings.Split(profile.String(), "\n") {
+			if strings.Contains(line, label) {
+				t.Fatalf("Run %d: expected no goroutines left once Serve returned. Got:\n%s", i, profile.String())
+			}
+		}
+	}
+}
+
+func TestRunErrReturnsListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	err = RunErr(l.Addr().String(), killTime, http.NewServeMux())
+	if err == nil {
+		t.Fatal("Expected an error when the address is already in use")
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "listen" {
+		t.Fatalf("Expected a listen error. Got %v", err)
+	}
+	if !strings.Contains(err.Error(), strconv.Quote(l.Addr().String())) {
+		t.Errorf("Expected the error to name the address. Got %v", err)
+	}
+}
+
+func TestMultipleServersStopIndependently(t *testing.T) {
+	newServer := func() (*Server, net.Listener) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		})
+		return &Server{Timeout: killTime, Server: &http.Server{Handler: mux}, NoSignalHandling: true}, l
+	}
+
+	api, apiListener := newServer()
+	admin, adminListener := newServer()
+	go api.Serve(apiListener)
+	go admin.Serve(adminListener)
+	time.Sleep(waitTime)
+
+	api.Stop(killTime)
+	select {
+	case <-api.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+
+	r, err := http.Get("http://" + adminListener.Addr().String())
+	if err != nil {
+		t.Fatal("Expected the admin server to keep serving:", err)
+	}
+	r.Body.Close()
+
+	admin.Stop(killTime)
+	select {
+	case <-admin.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+}
+
+func TestCustomSignals(t *testing.T) {
+	server, l, err := createLocalListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server, Signals: []os.Signal{syscall.SIGHUP}}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the custom signal to stop the server")
+	}
+}
+
+func TestNoSignalHandling(t *testing.T) {
+	// The application's own handler receives the signal instead.
+	app := make(chan os.Signal, 1)
+	signal.Notify(app, syscall.SIGHUP)
+	defer signal.Stop(app)
+
+	srv := &Server{
+		Timeout:          killTime,
+		Signals:          []os.Signal{syscall.SIGHUP},
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	<-app
+	time.Sleep(waitTime)
+
+	if srv.IsShuttingDown() {
+		t.Fatal("Expected the signal to be ignored by the server")
+	}
+	srv.Stop(killTime)
+	<-stopped
+}
+
+func TestConnStateDoesNotBlockAfterShutdown(t *testing.T) {
+	server, l, err := createLocalListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r, err := http.Get("http://" + l.Addr().String()); err == nil {
+				r.Body.Close()
+			}
+		}()
+	}
+
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+	<-srv.StopChan()
+
+	// state changes for connections the server no longer manages must
+	// not block.
+	done := make(chan struct{})
+	go func() {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		srv.Server.ConnState(server, http.StateNew)
+		srv.Server.ConnState(server, http.StateClosed)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeoutTime):
+		t.Fatal("ConnState blocked after connections stopped being managed")
+	}
+	wg.Wait()
+}
+
+func TestStopIsIdempotent(t *testing.T) {
+	server, l, err := createLocalListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	done := make(chan struct{})
+	go func() {
+		srv.Stop(killTime)
+		srv.Stop(killTime)
+		<-srv.StopChan()
+		srv.Stop(killTime)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for repeated stops to complete")
+	}
+}
+
+func writeTestCertificate(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"graceful"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestRunTLSBadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	err := RunTLS("127.0.0.1:0", filepath.Join(dir, "missing.pem"), filepath.Join(dir, "missing.key"), killTime, http.NewServeMux())
+	if err == nil {
+		t.Fatal("Expected an error when the certificate cannot be loaded")
+	}
+}
+
+func TestRunTLSConfigDrains(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var served int32
+	cfg := &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		atomic.AddInt32(&served, 1)
+		return &cert, nil
+	}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime)
+		rw.WriteHeader(http.StatusOK)
+	})
+	addr := freeAddr(t)
+	done := make(chan error, 1)
+	go func() { done <- RunTLSConfig(addr, cfg, timeoutTime, mux) }()
+
+	errc := make(chan error, 1)
+	go func() {
+		time.Sleep(waitTime)
+		client := http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		r, err := client.Get("https://" + addr)
+		if err == nil {
+			r.Body.Close()
+		}
+		errc <- err
+	}()
+
+	time.Sleep(waitTime * 2)
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal("Expected the TLS request to be drained:", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeoutTime * 2):
+		t.Fatal("Timed out while waiting for RunTLSConfig to return")
+	}
+	if atomic.LoadInt32(&served) == 0 {
+		t.Error("Expected the certificate to come from GetCertificate")
+	}
+}
+
+func TestGracefulTLSTimesOut(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime * 10)
+		rw.WriteHeader(http.StatusOK)
+	})
+	srv := &Server{
+		Timeout:          killTime,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: mux},
+		NoSignalHandling: true,
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServeTLS(certFile, keyFile)
+	<-srv.Ready()
+
+	errc := make(chan error, 1)
+	go func() {
+		client := http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		r, err := client.Get("https://" + srv.ListenerAddr().String())
+		if err == nil {
+			r.Body.Close()
+		}
+		errc <- err
+	}()
+
+	time.Sleep(waitTime * 2)
+	srv.Stop(killTime)
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("Expected the TLS connection to be killed at timeout")
+		}
+	case <-time.After(timeoutTime * 2):
+		t.Fatal("Timed out while waiting for the TLS connection to be killed")
+	}
+	<-stopped
+}
+
+func TestGracefulTLSDrainsHTTP2Streams(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime)
+		io.WriteString(rw, r.Proto)
+	})
+	srv := &Server{
+		Timeout:          timeoutTime,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: mux},
+		NoSignalHandling: true,
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServeTLS(certFile, keyFile)
+	<-srv.Ready()
+
+	type result struct {
+		proto string
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		client := http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		r, err := client.Get("https://" + srv.ListenerAddr().String())
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer r.Body.Close()
+		body, err := io.ReadAll(r.Body)
+		results <- result{string(body), err}
+	}()
+
+	time.Sleep(waitTime)
+	srv.Stop(timeoutTime)
+
+	res := <-results
+	if res.err != nil {
+		t.Fatal("Expected the active stream to finish:", res.err)
+	}
+	if res.proto != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2.0 to be negotiated. Got %q", res.proto)
+	}
+	<-stopped
+}
+
+func TestReadTimeoutReleasesStalledConnections(t *testing.T) {
+	server, l, err := createLocalListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ReadTimeout = waitTime
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	// send an incomplete request and never finish it
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Stop(0)
+
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("ReadTimeout did not release the stalled connection")
+	}
+}
+
+func TestGracefulPreservesServerConnState(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	var serverStates, srvStates int
+	var stateLock sync.Mutex
+
+	server, l, err := createLocalListener(killTime / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		stateLock.Lock()
+		serverStates++
+		stateLock.Unlock()
+	}
+	srv := &Server{
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			stateLock.Lock()
+			srvStates++
+			stateLock.Unlock()
+		},
+		Timeout:   killTime,
+		Server:    server,
+		interrupt: c,
+	}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := http.Get("http://" + l.Addr().String())
+			if err != nil {
+				t.Error("Error on Get:", err)
+				return
+			}
+			r.Body.Close()
+		}()
+	}
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+	wg.Wait()
+	<-stopped
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if serverStates != 24 || srvStates != 24 {
+		t.Errorf("Expected both ConnState callbacks to see 24 state changes. Got %d and %d", serverStates, srvStates)
+	}
+}
+
+func TestServeListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ServeListener(l, killTime, mux)
+		close(done)
+	}()
+	time.Sleep(waitTime)
+
+	r, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for ServeListener to return")
+	}
+
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("Expected the listener to be closed")
+	}
+}
+
+func TestGoroutineLabels(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+		NoSignalHandling: true,
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	// The watcher may not have set its labels yet when Ready is closed.
+	addr := fmt.Sprintf("%q:%q", "addr", srv.ListenerAddr().String())
+	role := fmt.Sprintf("%q:%q", "graceful", "signal-watcher")
+	var profile bytes.Buffer
+	found := false
+	for deadline := time.Now().Add(timeoutTime); !found && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		profile.Reset()
+		if err := pprof.Lookup("goroutine").WriteTo(&profile, 1); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(profile.String(), "\n") {
+			if strings.Contains(line, addr) && strings.Contains(line, role) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected a goroutine labelled with %s and %s. Got:\n%s", role, addr, profile.String())
+	}
+
+	srv.Stop(0)
+	<-stopped
+}
+
+func TestLogger(t *testing.T) {
+	server, l, err := createLocalListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:          killTime,
+		Server:           server,
+		NoSignalHandling: true,
+		Logger:           log.New(&buf, "", 0),
+	}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+
+	go func() {
+		if r, err := http.Get("http://" + l.Addr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+
+	expected := "shutting down\ntimeout reached\nclosing 1 connections\nclosing connection #1 from "
+	if !strings.HasPrefix(buf.String(), expected) || !strings.HasSuffix(buf.String(), " to "+l.Addr().String()+"\n") {
+		t.Errorf("Unexpected log output.\n  actual: %q\nexpected: %q", buf.String(), expected)
+	}
+}
+
+func TestConnectionID(t *testing.T) {
+	ids := make(chan uint64, 2)
+	var srv *Server
+	srv = &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			ConnState: func(conn net.Conn, state http.ConnState) {
+				if state == http.StateActive {
+					id, _ := srv.ConnectionID(conn)
+					ids <- id
+				}
+			},
+			Handler: http.NewServeMux(),
+		},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}
+
+	srv.Stop(killTime)
+	<-stopped
+	if first, second := <-ids, <-ids; second <= first {
+		t.Errorf("Expected increasing connection IDs. Got %d then %d", first, second)
+	}
+}
+
+func TestDrainLogInterval(t *testing.T) {
+	server, l, err := createLocalListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:          killTime,
+		DrainLogInterval: killTime / 3,
+		Server:           server,
+		NoSignalHandling: true,
+		Logger:           log.New(&buf, "", 0),
+	}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+
+	go func() {
+		if r, err := http.Get("http://" + l.Addr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+
+	if n := strings.Count(buf.String(), "draining: 1 connections remaining\n"); n < 2 {
+		t.Errorf("Expected drain progress to be logged at least twice. Got %d in %q", n, buf.String())
+	}
+}
+
+func TestWarnActiveAfter(t *testing.T) {
+	defer func(interval time.Duration) { activeCheckInterval = interval }(activeCheckInterval)
+	activeCheckInterval = waitTime / 2
+
+	server, l, err := createLocalListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:          killTime,
+		WarnActiveAfter:  waitTime * 2,
+		Server:           server,
+		NoSignalHandling: true,
+		Logger:           log.New(&buf, "", 0),
+	}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+
+	go func() {
+		if r, err := http.Get("http://" + l.Addr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+
+	if n := strings.Count(buf.String(), "has been active for"); n != 1 {
+		t.Errorf("Expected the active connection to be warned about once. Got %d in %q", n, buf.String())
+	}
+	if !strings.Contains(buf.String(), "connection #1 from ") {
+		t.Errorf("Expected the warning to name the connection. Got %q", buf.String())
+	}
+}
+
+func TestConnectionsKilledCallback(t *testing.T) {
+	for _, tt := range []struct {
+		sleep  time.Duration
+		killed int
+	}{
+		{sleep: 1 * time.Millisecond, killed: 0},
+		{sleep: killTime * 10, killed: 1},
+	} {
+		server, l, err := createLocalListener(tt.sleep)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		killed := make(chan int, 1)
+		srv := &Server{
+			Timeout:           killTime,
+			Server:            server,
+			NoSignalHandling:  true,
+			ConnectionsKilled: func(n int) { killed <- n },
+		}
+		go srv.Serve(l)
+
+		go func() {
+			if r, err := http.Get("http://" + l.Addr().String()); err == nil {
+				r.Body.Close()
+			}
+		}()
+		time.Sleep(waitTime)
+		srv.Stop(killTime)
+
+		select {
+		case n := <-killed:
+			if n != tt.killed {
+				t.Errorf("Expected %d connections to be killed. Got %d", tt.killed, n)
+			}
+		case <-time.After(timeoutTime):
+			t.Fatal("Timed out while waiting for ConnectionsKilled callback to be called")
+		}
+	}
+}
+
+func TestNegativeTimeoutClosesImmediately(t *testing.T) {
+	srv := &Server{
+		Timeout:          -1,
+		KillGrace:        timeoutTime,
+		NoSignalHandling: true,
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				time.Sleep(timeoutTime)
+			}),
+		},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	srv.Stop(-1)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrDrainTimeout) {
+			t.Errorf("Expected %v. Got %v", ErrDrainTimeout, err)
+		}
+	case <-time.After(killTime):
+		t.Fatal("Expected connections to be closed without draining")
+	}
+}
+
+func TestNegativeTimeoutWithoutConnections(t *testing.T) {
+	srv := &Server{
+		Timeout:          -1,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	srv.Stop(-1)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Expected no error when no connections were closed. Got %v", err)
+		}
+	case <-time.After(killTime):
+		t.Fatal("Expected the server to stop at once")
+	}
+	if stats, _ := srv.LastShutdown(); stats.TimedOut || stats.ConnectionsKilled != 0 {
+		t.Errorf("Expected the shutdown not to be reported as timed out. Got %+v", stats)
+	}
+}
+
+func TestTimeoutWithPendingTask(t *testing.T) {
+	var mu sync.Mutex
+	var events []ShutdownEvent
+	srv := &Server{
+		NoSignalHandling: true,
+		OnShutdownEvent: func(e ShutdownEvent, n int) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		},
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	release := srv.Track()
+	defer release()
+	srv.Stop(waitTime)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrDrainTimeout) {
+			t.Errorf("Expected %v with a task still running. Got %v", ErrDrainTimeout, err)
+		}
+	case <-time.After(killTime):
+		t.Fatal("Expected the server to stop once the timeout expired")
+	}
+	if stats, _ := srv.LastShutdown(); !stats.TimedOut {
+		t.Errorf("Expected the shutdown to be reported as timed out. Got %+v", stats)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range events {
+		if e == EventDrainComplete {
+			t.Errorf("Expected no %q event. Got %v", e, events)
+		}
+	}
+}
+
+func TestEvictAge(t *testing.T) {
+	var srv *Server
+	srv = &Server{
+		Timeout:          timeoutTime,
+		EvictAge:         killTime,
+		NoSignalHandling: true,
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				time.Sleep(2 * timeoutTime)
+			}),
+		},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	evicted := make(chan time.Time, 1)
+	go func() {
+		if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+		evicted <- time.Now()
+	}()
+	time.Sleep(killTime + waitTime)
+
+	start := time.Now()
+	srv.Stop(timeoutTime)
+	select {
+	case at := <-evicted:
+		if elapsed := at.Sub(start); elapsed < timeoutTime*9/10 {
+			t.Errorf("Expected the connection to be evicted in the last tenth of the timeout. Took %v", elapsed)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected the old connection to be evicted before the timeout")
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Expected no connections to be killed. Got %v", err)
+	}
+}
+
+func TestKillGrace(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime + waitTime*2)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	killed := make(chan int, 1)
+	srv := &Server{
+		Timeout:           killTime,
+		KillGrace:         killTime,
+		NoSignalHandling:  true,
+		ConnectionsKilled: func(n int) { killed <- n },
+		Server:            &http.Server{Addr: "127.0.0.1:0", Handler: mux},
+	}
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	errc := make(chan error, 1)
+	go func() {
+		r, err := http.Get("http://" + srv.ListenerAddr().String())
+		if err == nil {
+			r.Body.Close()
+		}
+		errc <- err
+	}()
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+
+	if err := <-errc; err != nil {
+		t.Error("Expected the request to finish within the grace period:", err)
+	}
+	if n := <-killed; n != 0 {
+		t.Errorf("Expected no connections to be killed. Got %d", n)
+	}
+}
+
+func TestExtendDrain(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime + waitTime*2)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	var extensions []int
+	killed := make(chan int, 1)
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		ExtendDrain: func(remaining int) time.Duration {
+			extensions = append(extensions, remaining)
+			return waitTime * 2
+		},
+		ConnectionsKilled: func(n int) { killed <- n },
+		Server:            &http.Server{Addr: "127.0.0.1:0", Handler: mux},
+	}
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	errc := make(chan error, 1)
+	go func() {
+		r, err := http.Get("http://" + srv.ListenerAddr().String())
+		if err == nil {
+			r.Body.Close()
+		}
+		errc <- err
+	}()
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+
+	if err := <-errc; err != nil {
+		t.Error("Expected the request to finish once the drain was extended:", err)
+	}
+	if n := <-killed; n != 0 {
+		t.Errorf("Expected no connections to be killed. Got %d", n)
+	}
+	if len(extensions) == 0 || extensions[0] != 1 {
+		t.Errorf("Expected ExtendDrain to be consulted with 1 remaining connection. Got %v", extensions)
+	}
+}
+
+func TestMaxDrainExtensions(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(timeoutTime * 2)
+	})
+
+	extensions := 0
+	srv := &Server{
+		Timeout:            killTime,
+		NoSignalHandling:   true,
+		MaxDrainExtensions: 2,
+		ExtendDrain: func(remaining int) time.Duration {
+			extensions++
+			return waitTime
+		},
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: mux},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+
+	if err := <-errc; !errors.Is(err, ErrDrainTimeout) {
+		t.Errorf("Expected ErrDrainTimeout once the extensions ran out. Got %v", err)
+	}
+	if extensions != 2 {
+		t.Errorf("Expected the drain to be extended 2 times. Got %d", extensions)
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	addr := freeAddr(t)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ServeContext(ctx, addr, killTime, http.NewServeMux())
+	}()
+	time.Sleep(waitTime)
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("Expected %v. Got %v", context.Canceled, err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for ServeContext to return")
+	}
+}
+
+func TestKeepAliveTightensDuringDelay(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		ShutdownDelay:    timeoutTime,
+		KeepAliveTimeout: 10 * time.Second,
+		KeepAliveMax:     100,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	keepAlive := func() string {
+		r, err := http.Get("http://" + srv.ListenerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r.Header.Get("Keep-Alive")
+	}
+	if h := keepAlive(); h != "timeout=10, max=100" {
+		t.Errorf("Expected the configured parameters to be advertised. Got %q", h)
+	}
+
+	srv.Stop(killTime)
+	<-srv.ShuttingDown()
+	time.Sleep(timeoutTime / 2)
+	var max int
+	if n, err := fmt.Sscanf(keepAlive(), "timeout=1, max=%d", &max); n != 1 || err != nil {
+		t.Fatalf("Expected the timeout to be cut to the rest of the delay. Got %v", err)
+	}
+	if max < 1 || max > 60 {
+		t.Errorf("Expected the maximum to have shrunk to about half. Got %d", max)
+	}
+	<-stopped
+}
+
+func TestPrefixMux(t *testing.T) {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			io.WriteString(rw, name)
+		})
+	}
+	mux := prefixMux(map[string]http.Handler{
+		"/":       named("main"),
+		"/admin/": named("admin"),
+	})
+
+	for path, want := range map[string]string{
+		"/":              "main",
+		"/users":         "main",
+		"/admin/":        "admin",
+		"/admin/metrics": "admin",
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if got := rec.Body.String(); got != want {
+			t.Errorf("Expected %s to be served by the %s handler. Got %q", path, want, got)
+		}
+	}
+}
+
+func TestRejectDraining(t *testing.T) {
+	srv := &Server{}
+	served := 0
+	h := srv.RejectDraining(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec
+	}
+
+	if rec := serve(); rec.Code != http.StatusOK || served != 1 {
+		t.Errorf("Expected requests to be served before shutdown. Got %d", rec.Code)
+	}
+
+	srv.stopLock.Lock()
+	srv.closing = time.Now().Add(timeoutTime)
+	srv.stopLock.Unlock()
+	if rec := serve(); rec.Code != http.StatusOK || served != 2 {
+		t.Errorf("Expected requests to be served during the shutdown delay. Got %d", rec.Code)
+	}
+
+	srv.stopLock.Lock()
+	srv.closing = time.Now()
+	srv.stopLock.Unlock()
+	rec := serve()
+	if rec.Code != http.StatusServiceUnavailable || served != 2 {
+		t.Errorf("Expected new requests to be rejected while draining. Got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Connection"); got != "close" {
+		t.Errorf("Expected Connection: close. Got %q", got)
+	}
+}
+
+func TestRejectDrainingCompletesInFlight(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0"},
+	}
+	srv.Handler = srv.RejectDraining(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(rw, "done")
+	}))
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: graceful\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	srv.Stop(timeoutTime)
+	for !srv.draining() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	r, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(r.Body)
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK || string(body) != "done" {
+		t.Errorf("Expected the in-flight request to complete. Got %d %q", r.StatusCode, body)
+	}
+	<-stopped
+}
+
+func TestServeContextBoundsListen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := ServeContext(ctx, "127.0.0.1:0", killTime, http.NewServeMux())
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected an error wrapping %v. Got %v", context.Canceled, err)
+	}
+	if !strings.Contains(err.Error(), "127.0.0.1:0") {
+		t.Errorf("Expected the error to name the address. Got %v", err)
+	}
+}
+
+func TestServeFunc(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+
+	errc := make(chan error, 1)
+	serve := srv.ServeFunc(ctx)
+	go func() { errc <- serve() }()
+	<-srv.Ready()
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Expected a clean shutdown. Got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+}
+
+func TestCleanShutdownReturnsNil(t *testing.T) {
+	errc := make(chan error, 1)
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	<-srv.Ready()
+	srv.Stop(killTime)
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Expected no error after a clean shutdown. Got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for ListenAndServe to return")
+	}
+}
+
+func TestDrainTimeoutError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(timeoutTime)
+	})
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: mux},
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrDrainTimeout) {
+			t.Fatalf("Expected %v. Got %v", ErrDrainTimeout, err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for ListenAndServe to return")
+	}
+}
+
+func TestServeReturnsListenerError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Handler: http.NewServeMux()},
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(l)
+	}()
+	<-srv.Ready()
+
+	// closing the listener without shutting down is a failure
+	l.Close()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("Expected an error when the listener fails")
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for Serve to return")
+	}
+}
+
+func TestTrackRequestsWaitsForHijackedRequests(t *testing.T) {
+	var finished bool
+	var finishLock sync.Mutex
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		bufrw.Flush()
+
+		time.Sleep(killTime)
+		finishLock.Lock()
+		finished = true
+		finishLock.Unlock()
+	})
+
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+	}
+	srv.Server = &http.Server{Addr: "127.0.0.1:0", Handler: srv.TrackRequests(mux)}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	if n := srv.ActiveConnections(); n != 0 {
+		t.Fatalf("Expected the hijacked connection not to be managed. Got %d", n)
+	}
+
+	srv.Stop(timeoutTime)
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for the server to stop")
+	}
+
+	finishLock.Lock()
+	defer finishLock.Unlock()
+	if !finished {
+		t.Error("Expected shutdown to wait for the hijacked request to return")
+	}
+}
+
+type closingHandler struct {
+	http.Handler
+	closed chan struct{}
+}
+
+func (h closingHandler) Close() error {
+	close(h.closed)
+	return errors.New("close failed")
+}
+
+func TestReload(t *testing.T) {
+	respond := func(body string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			io.WriteString(rw, body)
+		})
+	}
+
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: respond("old")},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	get := func() string {
+		r, err := http.Get("http://" + srv.ListenerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		body, _ := io.ReadAll(r.Body)
+		return string(body)
+	}
+
+	if body := get(); body != "old" {
+		t.Errorf("Expected the original handler. Got %q", body)
+	}
+	srv.Reload(respond("new"))
+	if body := get(); body != "new" {
+		t.Errorf("Expected the reloaded handler. Got %q", body)
+	}
+
+	srv.Stop(killTime)
+	<-stopped
+}
+
+func TestCloseHandler(t *testing.T) {
+	handler := closingHandler{Handler: http.NewServeMux(), closed: make(chan struct{})}
+	srv := &Server{
+		Timeout:          killTime,
+		CloseHandler:     true,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: handler},
+	}
+	stopped := srv.StopChan()
+
+	errc := make(chan error, 1)
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			errc <- err
+			return
+		}
+		errc <- srv.Serve(l)
+	}()
+	<-srv.Ready()
+	srv.Stop(killTime)
+
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for the server to stop")
+	}
+	select {
+	case <-handler.closed:
+	default:
+		t.Fatal("Expected the handler to be closed before the server stopped")
+	}
+	if err := <-errc; err == nil || err.Error() != "close failed" {
+		t.Errorf("Expected the error from Close. Got %v", err)
+	}
+}
+
+// panickingCloser is a handler whose Close panics.
+type panickingCloser struct {
+	http.Handler
+}
+
+func (panickingCloser) Close() error {
+	panic("close handler")
+}
+
+func TestPanickingCloseHandler(t *testing.T) {
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:          killTime,
+		CloseHandler:     true,
+		NoSignalHandling: true,
+		Logger:           log.New(&buf, "", 0),
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: panickingCloser{http.NewServeMux()}},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+	srv.Stop(killTime)
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Expected a clean shutdown. Got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected the server to stop despite the panic")
+	}
+	if !strings.Contains(buf.String(), "panic in CloseHandler: close handler") {
+		t.Errorf("Expected the panic to be logged. Got %q", buf.String())
+	}
+}
+
+func TestPanickingHooks(t *testing.T) {
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:           killTime,
+		NoSignalHandling:  true,
+		Logger:            log.New(&buf, "", 0),
+		ConnState:         func(net.Conn, http.ConnState) { panic("conn state") },
+		ShutdownInitiated: func() { panic("initiated") },
+		ShutdownCompleted: func() { panic("completed") },
+		Server:            &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	r, err := http.Get("http://" + srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	srv.Stop(killTime)
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected shutdown to complete despite the panics")
+	}
+
+	for _, msg := range []string{"panic in ConnState: conn state", "panic in ShutdownInitiated: initiated", "panic in ShutdownCompleted: completed"} {
+		if !strings.Contains(buf.String(), msg) {
+			t.Errorf("Expected %q to be logged. Got %q", msg, buf.String())
+		}
+	}
+}
+
+func TestPanickingShouldKill(t *testing.T) {
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Logger:           log.New(&buf, "", 0),
+		ShouldKill:       func(net.Conn) bool { panic("should kill") },
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			time.Sleep(timeoutTime)
+		})},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: graceful\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	var timeoutErr *DrainTimeoutError
+	if err := <-errc; !errors.As(err, &timeoutErr) || len(timeoutErr.Remaining) != 1 {
+		t.Fatalf("Expected the connection to be killed despite the panic. Got %v", err)
+	}
+	if !strings.Contains(buf.String(), "panic in ShouldKill: should kill") {
+		t.Errorf("Expected the panic to be logged. Got %q", buf.String())
+	}
+}
+
+func TestPanickingCanComplete(t *testing.T) {
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		Logger:           log.New(&buf, "", 0),
+		CanComplete:      func() bool { panic("can complete") },
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	srv.Stop(timeoutTime)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Expected the shutdown to complete. Got %v", err)
+		}
+	case <-time.After(killTime):
+		t.Fatal("Expected a panicking CanComplete to allow the shutdown to complete")
+	}
+	if !strings.Contains(buf.String(), "panic in CanComplete: can complete") {
+		t.Errorf("Expected the panic to be logged. Got %q", buf.String())
+	}
+}
+
+func TestPanickingRetryAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptErr := fmt.Errorf("too many open files")
+
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Logger:           log.New(&buf, "", 0),
+		RetryAccept:      func(error) bool { panic("retry accept") },
+		Server:           &http.Server{Handler: http.NewServeMux()},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(failingListener{l, acceptErr, &sync.Once{}}) }()
+
+	select {
+	case err := <-errc:
+		if err != acceptErr {
+			t.Errorf("Expected the accept error not to be retried. Got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected serving to stop on the accept error")
+	}
+	if !strings.Contains(buf.String(), "panic in RetryAccept: retry accept") {
+		t.Errorf("Expected the panic to be logged. Got %q", buf.String())
+	}
+}
+
+func TestCanComplete(t *testing.T) {
+	var ready int32
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		CanComplete:      func() bool { return atomic.LoadInt32(&ready) == 1 },
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	srv.Stop(timeoutTime)
+	select {
+	case <-stopped:
+		t.Fatal("Expected CanComplete to hold up the shutdown")
+	case <-time.After(killTime):
+	}
+
+	atomic.StoreInt32(&ready, 1)
+	select {
+	case <-stopped:
+	case <-time.After(killTime):
+		t.Fatal("Expected the shutdown to complete once CanComplete allowed it")
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Expected a clean shutdown. Got %v", err)
+	}
+}
+
+func TestOnShutdownEvent(t *testing.T) {
+	var events []ShutdownEvent
+	var eventsLock sync.Mutex
+	srv := &Server{
+		Timeout:          killTime,
+		DrainLogInterval: waitTime,
+		NoSignalHandling: true,
+		Logger:           log.New(io.Discard, "", 0),
+		OnShutdownEvent: func(event ShutdownEvent, connections int) {
+			eventsLock.Lock()
+			defer eventsLock.Unlock()
+			if len(events) == 0 || events[len(events)-1] != event {
+				events = append(events, event)
+			}
+		},
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				time.Sleep(timeoutTime)
+			}),
+		},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	<-stopped
+
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	expected := []ShutdownEvent{EventShutdownInitiated, EventListenerClosed, EventConnectionsRemaining, EventConnectionsKilled}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected events %v. Got %v", expected, events)
+	}
+}
+
+func TestOnShutdownEventWithoutStop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []ShutdownEvent
+	var eventsLock sync.Mutex
+	srv := &Server{
+		NoSignalHandling: true,
+		Logger:           log.New(io.Discard, "", 0),
+		OnShutdownEvent: func(event ShutdownEvent, connections int) {
+			eventsLock.Lock()
+			defer eventsLock.Unlock()
+			events = append(events, event)
+		},
+		Server: &http.Server{Handler: http.NewServeMux()},
+	}
+	acceptErr := fmt.Errorf("too many open files")
+	if err := srv.Serve(failingListener{l, acceptErr, &sync.Once{}}); err != acceptErr {
+		t.Fatalf("Expected the accept error. Got %v", err)
+	}
+
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	expected := []ShutdownEvent{EventShutdownInitiated, EventDrainComplete}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected events %v. Got %v", expected, events)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				time.Sleep(timeoutTime)
+			}),
+		},
+	}
+	events := srv.Events()
+	if srv.Events() != events {
+		t.Error("Expected every call to return the same channel")
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	<-stopped
+
+	var got []Event
+	for len(events) > 0 {
+		got = append(got, <-events)
+	}
+	expected := []ShutdownEvent{EventShutdownInitiated, EventListenerClosed, EventConnectionsKilled}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected events %v. Got %+v", expected, got)
+	}
+	for i, e := range got {
+		if e.Kind != expected[i] || e.Connections != 1 {
+			t.Errorf("Expected event %d to be %s with 1 connection. Got %+v", i, expected[i], e)
+		}
+		if i > 0 && e.Time.Before(got[i-1].Time) {
+			t.Errorf("Expected events in order. Got %+v", got)
+		}
+	}
+}
+
+func TestEventsDoNotBlock(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		DrainLogInterval: time.Millisecond,
+		NoSignalHandling: true,
+		Logger:           log.New(io.Discard, "", 0),
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				time.Sleep(timeoutTime)
+			}),
+		},
+	}
+	events := srv.Events()
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected the shutdown not to wait for events to be received")
+	}
+	if n := len(events); n != cap(events) {
+		t.Errorf("Expected the unread events to fill the channel. Got %d of %d", n, cap(events))
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	release := make(chan struct{})
+	srv := &Server{
+		Timeout:          2 * timeoutTime,
+		NoSignalHandling: true,
+		Logger:           log.New(io.Discard, "", 0),
+		RequestPriority: func(r *http.Request) int {
+			if r.Header.Get("X-Priority") == "high" {
+				return 1
+			}
+			return 0
+		},
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-release
+			io.WriteString(rw, "done")
+		})},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	dial := func(priority string) net.Conn {
+		conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: graceful\r\nX-Priority: "+priority+"\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	low, high := dial("low"), dial("high")
+	defer low.Close()
+	defer high.Close()
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.Stop(2 * timeoutTime)
+	low.SetReadDeadline(time.Now().Add(2 * timeoutTime))
+	if _, err := low.Read(make([]byte, 1)); err == nil || isNetTimeout(err) {
+		t.Fatalf("Expected the low-priority connection to be closed before the timeout. Got %v", err)
+	}
+	if closed := time.Since(start); closed < 2*timeoutTime-2*timeoutTime/10 {
+		t.Errorf("Expected the low-priority connection to be closed in the last tenth of the timeout. Closed after %v", closed)
+	}
+
+	close(release)
+	r, err := http.ReadResponse(bufio.NewReader(high), nil)
+	if err != nil {
+		t.Fatalf("Expected the high-priority request to be protected. Got %v", err)
+	}
+	r.Body.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Expected the drain to finish without killing connections. Got %v", err)
+	}
+}
+
+func TestOnForceClose(t *testing.T) {
+	forced := make(chan net.Conn, 1)
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		OnForceClose: func(conn net.Conn) {
+			conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n"))
+			forced <- conn
+		},
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				time.Sleep(timeoutTime)
+			}),
+		},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	codes := make(chan int, 1)
+	go func() {
+		r, err := http.Get("http://" + srv.ListenerAddr().String())
+		if err != nil {
+			codes <- 0
+			return
+		}
+		r.Body.Close()
+		codes <- r.StatusCode
+	}()
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	<-stopped
+	if len(forced) != 1 {
+		t.Fatal("Expected OnForceClose to be called with the remaining connection")
+	}
+	if code := <-codes; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the response written by OnForceClose. Got %d", code)
+	}
+}
+
+func TestShouldKill(t *testing.T) {
+	var spared string
+	killed := make(chan int, 1)
+	srv := &Server{
+		Timeout:           killTime,
+		NoSignalHandling:  true,
+		ShouldKill:        func(conn net.Conn) bool { return conn.RemoteAddr().String() != spared },
+		ConnectionsKilled: func(n int) { killed <- n },
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				time.Sleep(timeoutTime)
+			}),
+		},
+	}
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		conns = append(conns, conn)
+	}
+	spared = conns[0].LocalAddr().String()
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	if n := <-killed; n != 1 {
+		t.Errorf("Expected 1 connection to be killed. Got %d", n)
+	}
+
+	r, err := http.ReadResponse(bufio.NewReader(conns[0]), nil)
+	if err != nil {
+		t.Fatalf("Expected the spared connection to finish its request. Got %v", err)
+	}
+	r.Body.Close()
+	if _, err := http.ReadResponse(bufio.NewReader(conns[1]), nil); err == nil {
+		t.Error("Expected the other connection to be closed")
+	}
+}
+
+func TestSkipDrain(t *testing.T) {
+	type connKey struct{}
+	var streaming sync.Map
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(rw http.ResponseWriter, r *http.Request) {
+		streaming.Store(r.Context().Value(connKey{}), true)
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime)
+		rw.WriteHeader(http.StatusOK)
+	})
+	srv := &Server{
+		Timeout:          timeoutTime * 5,
+		NoSignalHandling: true,
+		SkipDrain: func(conn net.Conn) bool {
+			_, ok := streaming.Load(conn)
+			return ok
+		},
+		Server: &http.Server{
+			Addr:    "127.0.0.1:0",
+			Handler: mux,
+			ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+				return context.WithValue(ctx, connKey{}, conn)
+			},
+		},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	events, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Close()
+	events.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	eventsReader := bufio.NewReader(events)
+	r, err := http.ReadResponse(eventsReader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	normal, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer normal.Close()
+	normal.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.Stop(srv.Timeout)
+
+	if r, err := http.ReadResponse(bufio.NewReader(normal), nil); err != nil {
+		t.Fatal("Expected the normal request to finish:", err)
+	} else {
+		r.Body.Close()
+	}
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected shutdown not to wait for the streaming connection")
+	}
+	if elapsed := time.Since(start); elapsed >= srv.Timeout {
+		t.Errorf("Expected shutdown to finish before the timeout. Took %v", elapsed)
+	}
+	if _, err := io.ReadAll(r.Body); err == nil {
+		t.Error("Expected the streaming connection to be closed")
+	}
+}
+
+func TestShutdownReported(t *testing.T) {
+	reported := make(chan ShutdownStats, 1)
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		ShutdownReported: func(stats ShutdownStats) { reported <- stats },
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				time.Sleep(timeoutTime)
+			}),
+		},
+	}
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+				r.Body.Close()
+			}
+		}()
+	}
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	select {
+	case stats := <-reported:
+		if stats.PeakConnections != 2 || stats.ConnectionsKilled != 2 || !stats.TimedOut {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+		if stats.Drain < killTime {
+			t.Errorf("Expected the drain to last at least %v. Got %v", killTime, stats.Drain)
+		}
+		if stats.Shutdown < stats.Drain {
+			t.Errorf("Expected the shutdown to last at least the drain %v. Got %v", stats.Drain, stats.Shutdown)
+		}
+		<-srv.StopChan()
+		if last, ok := srv.LastShutdown(); !ok || last != stats {
+			t.Errorf("Expected LastShutdown to return the reported %+v. Got %+v", stats, last)
+		}
+		if n := srv.KilledConnections(); n != 2 {
+			t.Errorf("Expected 2 killed connections. Got %d", n)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for the shutdown to be reported")
+	}
+}
+
+func TestShutdownReportedIncludesDelay(t *testing.T) {
+	reported := make(chan ShutdownStats, 1)
+	srv := &Server{
+		Timeout:          killTime,
+		ShutdownDelay:    waitTime,
+		NoSignalHandling: true,
+		ShutdownReported: func(stats ShutdownStats) { reported <- stats },
+		Server: &http.Server{
+			Addr:    "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		},
+	}
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	srv.Stop(killTime)
+	select {
+	case stats := <-reported:
+		if stats.TimedOut || stats.ConnectionsKilled != 0 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+		if stats.Shutdown < waitTime {
+			t.Errorf("Expected the shutdown to include the %v delay. Got %v", waitTime, stats.Shutdown)
+		}
+		if stats.Drain >= waitTime {
+			t.Errorf("Expected the drain to exclude the %v delay. Got %v", waitTime, stats.Drain)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for the shutdown to be reported")
+	}
+}
+
+func TestCountRequests(t *testing.T) {
+	returned := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		bufrw.Flush()
+
+		time.Sleep(killTime)
+		close(returned)
+	})
+
+	srv := &Server{
+		Timeout:          timeoutTime,
+		CountRequests:    true,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: mux},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	srv.Stop(timeoutTime)
+	<-stopped
+	select {
+	case <-returned:
+	default:
+		t.Error("Expected shutdown to wait for the request to return")
+	}
+}
+
+func TestOnHijackedShutdown(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		_, bufrw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		bufrw.Flush()
+	})
+
+	var srv *Server
+	srv = &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		OnHijackedShutdown: func(conn net.Conn) {
+			conn.Write([]byte("bye"))
+			conn.Close()
+			srv.ReleaseHijacked(conn)
+		},
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: mux},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	if _, err := http.ReadResponse(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := srv.HijackedConnections(); n != 1 {
+		t.Fatalf("Expected 1 hijacked connection. Got %d", n)
+	}
+
+	srv.Stop(timeoutTime)
+	<-stopped
+
+	conn.SetReadDeadline(time.Now().Add(killTime))
+	msg, _ := io.ReadAll(r)
+	if string(msg) != "bye" {
+		t.Errorf("Expected the hijacked connection to be notified. Got %q", msg)
+	}
+	if n := srv.HijackedConnections(); n != 0 {
+		t.Errorf("Expected the hijacked connection to be released. Got %d", n)
+	}
+}
+
+func TestWait(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+
+	var completed bool
+	var completedLock sync.Mutex
+	srv.ShutdownCompleted = func() {
+		completedLock.Lock()
+		completed = true
+		completedLock.Unlock()
+	}
+
+	go srv.ListenAndServe()
+	<-srv.Ready()
+	srv.Stop(killTime)
+
+	waited := make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for Wait to return")
+	}
+
+	completedLock.Lock()
+	defer completedLock.Unlock()
+	if !completed {
+		t.Error("Expected Wait to return once shutdown had completed")
+	}
+}
+
+func TestServeWithSignalChan(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	addr := freeAddr(t)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ServeWithSignalChan(addr, killTime, mux, c)
+	}()
+	time.Sleep(waitTime)
+
+	r, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	c <- os.Interrupt
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Expected no error after a clean shutdown. Got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for ServeWithSignalChan to return")
+	}
+
+	// the channel belongs to the caller and must still be usable
+	c <- os.Interrupt
+}
+
+func TestTrackWaitsForBackgroundTasks(t *testing.T) {
+	var finished bool
+	var finishLock sync.Mutex
+
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		release := srv.Track()
+		go func() {
+			defer release()
+			time.Sleep(killTime)
+			finishLock.Lock()
+			finished = true
+			finishLock.Unlock()
+		}()
+		rw.WriteHeader(http.StatusOK)
+	})
+	srv.Server = &http.Server{Addr: "127.0.0.1:0", Handler: mux}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	r, err := http.Get("http://" + srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	srv.Stop(timeoutTime)
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for the server to stop")
+	}
+
+	finishLock.Lock()
+	defer finishLock.Unlock()
+	if !finished {
+		t.Error("Expected shutdown to wait for the background task")
+	}
+}
+
+// failingListener fails the first call to Accept with err.
+type failingListener struct {
+	net.Listener
+	err  error
+	once *sync.Once
+}
+
+func (l failingListener) Accept() (net.Conn, error) {
+	var err error
+	l.once.Do(func() { err = l.err })
+	if err != nil {
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+// stuckListener never returns from Accept once closed, until release is
+// closed.
+type stuckListener struct {
+	net.Listener
+	release chan struct{}
+}
+
+func (l stuckListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.release
+	}
+	return conn, err
+}
+
+func TestServeStopTimeout(t *testing.T) {
+	defer func(d time.Duration) { serveStopTimeout = d }(serveStopTimeout)
+	serveStopTimeout = waitTime
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+
+	srv := &Server{
+		NoSignalHandling: true,
+		Server:           &http.Server{Handler: http.NewServeMux()},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(stuckListener{l, release}) }()
+	<-srv.Ready()
+
+	srv.Stop(0)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Expected a clean shutdown. Got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for Serve to return")
+	}
+}
+
+// proxyListener reports a fixed client address for its connections, as a
+// PROXY protocol listener would.
+type proxyListener struct {
+	net.Listener
+	client net.Addr
+}
+
+type proxyConn struct {
+	net.Conn
+	client net.Addr
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return proxyConn{conn, l.client}, nil
+}
+
+func (c proxyConn) RemoteAddr() net.Addr {
+	return c.client
+}
+
+func TestWrappedListenerConnectionsAreTracked(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4242}
+
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Logger:           log.New(&buf, "", 0),
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			time.Sleep(timeoutTime)
+		})},
+	}
+	stopped := srv.StopChan()
+	go srv.Serve(proxyListener{l, client})
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + l.Addr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	<-stopped
+	if !strings.Contains(buf.String(), "closing connection #1 from 203.0.113.7:4242") {
+		t.Errorf("Expected the client address from the wrapped listener to be logged. Got %q", buf.String())
+	}
+}
+
+func TestRetryAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptErr := fmt.Errorf("too many open files")
+
+	retried := make(chan error, 1)
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Logger:           log.New(io.Discard, "", 0),
+		RetryAccept: func(err error) bool {
+			retried <- err
+			return true
+		},
+		Server: &http.Server{Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.Serve(failingListener{l, acceptErr, &sync.Once{}})
+	<-srv.Ready()
+
+	r, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal("Expected the server to keep serving after the accept error:", err)
+	}
+	r.Body.Close()
+
+	select {
+	case err := <-retried:
+		if err != acceptErr {
+			t.Errorf("Expected RetryAccept to be called with %v. Got %v", acceptErr, err)
+		}
+	default:
+		t.Error("Expected RetryAccept to be called")
+	}
+
+	srv.Stop(killTime)
+	<-stopped
+}
+
+// breakingListener fails to accept, with err, once broken is closed.
+type breakingListener struct {
+	net.Listener
+	broken chan struct{}
+	err    error
+}
+
+func (l breakingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	select {
+	case <-l.broken:
+		if err == nil {
+			conn.Close()
+		}
+		return nil, l.err
+	default:
+		return conn, err
+	}
+}
+
+func TestServeErrorStopsSignalWatcher(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptErr := &net.OpError{Op: "accept", Net: "tcp", Err: errors.New("broken listener")}
+	broken := make(chan struct{})
+	close(broken)
+
+	srv := &Server{
+		Timeout: killTime,
+		Server:  &http.Server{Handler: http.NewServeMux()},
+	}
+	go func() {
+		if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	if err := srv.Serve(breakingListener{l, broken, acceptErr}); err != acceptErr {
+		t.Fatalf("Expected the accept error to be returned. Got %v", err)
+	}
+
+	// Leave a leaked watcher time to label itself.
+	time.Sleep(waitTime)
+	var profile bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&profile, 1); err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("%q:%q", "addr", l.Addr().String())
+	for _, line := range strings.Split(profile.String(), "\n") {
+		if strings.Contains(line, addr) {
+			t.Fatalf("Expected no goroutines left once Serve returned. Got:\n%s", profile.String())
+		}
+	}
+}
+
+// lingeringListener returns from Accept only after delay once it fails, as
+// when the listener is closed, like a Serve call which is slow to return.
+type lingeringListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l lingeringListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		time.Sleep(l.delay)
+	}
+	return conn, err
+}
+
+func TestDrainBeginsBeforeServeReturns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hijacked := make(chan struct{})
+	notified := make(chan time.Time, 1)
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if _, _, err := rw.(http.Hijacker).Hijack(); err != nil {
+				t.Error(err)
+			}
+			close(hijacked)
+		})},
+	}
+	// Hijacked connections are notified as the drain begins.
+	srv.OnHijackedShutdown = func(conn net.Conn) {
+		notified <- time.Now()
+		srv.ReleaseHijacked(conn)
+		conn.Close()
+	}
+	stopped := srv.StopChan()
+	go srv.Serve(lingeringListener{l, timeoutTime})
+	<-srv.Ready()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: graceful\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	<-hijacked
+
+	start := time.Now()
+	srv.Stop(killTime)
+	select {
+	case at := <-notified:
+		if elapsed := at.Sub(start); elapsed >= timeoutTime/2 {
+			t.Errorf("Expected the drain to begin once the listener closed, before Serve returned. Took %v", elapsed)
+		}
+	case <-time.After(2 * timeoutTime):
+		t.Fatal("Timed out waiting for the drain to begin")
+	}
+	<-stopped
+}
+
+func TestServeReturnsUnexpectedAcceptError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptErr := &net.OpError{Op: "accept", Net: "tcp", Err: errors.New("broken listener")}
+	broken := make(chan struct{})
+
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		Logger:           log.New(&buf, "", 0),
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			time.Sleep(killTime)
+		})},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(breakingListener{l, broken, acceptErr}) }()
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + l.Addr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+	close(broken)
+	if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		conn.Close()
+	}
+
+	// A shutdown requested while draining does not hide the error.
+	time.Sleep(waitTime)
+	srv.Stop(timeoutTime)
+
+	if err := <-errc; err != acceptErr {
+		t.Errorf("Expected the accept error to be returned. Got %v", err)
+	}
+	if !strings.Contains(buf.String(), "serving stopped unexpectedly: accept tcp: broken listener") {
+		t.Errorf("Expected the unexpected stop to be logged. Got %q", buf.String())
+	}
+}
+
+func TestCancelOnShutdown(t *testing.T) {
+	type key struct{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(key{}) != "base" {
+			t.Error("Expected the server's BaseContext to be preserved")
+		}
+		select {
+		case <-r.Context().Done():
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		case <-time.After(timeoutTime):
+			rw.WriteHeader(http.StatusOK)
+		}
+	})
+
+	srv := &Server{
+		Timeout:          timeoutTime,
+		CancelOnShutdown: true,
+		NoSignalHandling: true,
+		Server: &http.Server{
+			Addr:    "127.0.0.1:0",
+			Handler: mux,
+			BaseContext: func(net.Listener) context.Context {
+				return context.WithValue(context.Background(), key{}, "base")
+			},
+		},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	codes := make(chan int, 1)
+	go func() {
+		r, err := http.Get("http://" + srv.ListenerAddr().String())
+		if err != nil {
+			codes <- 0
+			return
+		}
+		r.Body.Close()
+		codes <- r.StatusCode
+	}()
+	time.Sleep(waitTime)
+
+	srv.Stop(timeoutTime)
+	select {
+	case code := <-codes:
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("Expected the request context to be cancelled. Got status %d", code)
+		}
+	case <-time.After(killTime):
+		t.Fatal("Timed out waiting for the request to be cancelled")
+	}
+	<-stopped
+}
+
+func TestShutdownCompletedCallback(t *testing.T) {
+	server, l, err := createLocalListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var initiated, completed bool
+	var stateLock sync.Mutex
+	srv := &Server{
+		Server:           server,
+		NoSignalHandling: true,
+		ShutdownInitiated: func() {
+			stateLock.Lock()
+			initiated = true
+			stateLock.Unlock()
+		},
+		ShutdownCompleted: func() {
+			stateLock.Lock()
+			if !initiated {
+				t.Error("ShutdownCompleted was called before ShutdownInitiated")
+			}
+			completed = true
+			stateLock.Unlock()
+		},
+	}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if !completed {
+		t.Fatal("Expected ShutdownCompleted to be called before the stop channel was closed")
+	}
+}
+
+func TestShuttingDown(t *testing.T) {
+	srv := &Server{Timeout: killTime, NoSignalHandling: true}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(killTime * 10):
+			rw.WriteHeader(http.StatusOK)
+		case <-srv.ShuttingDown():
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Server = &http.Server{Handler: mux}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+
+	status := make(chan int, 1)
+	go func() {
+		r, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			status <- 0
+			return
+		}
+		r.Body.Close()
+		status <- r.StatusCode
+	}()
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+	if code := <-status; code != http.StatusServiceUnavailable {
+		t.Errorf("Incorrect status code on response. Expected %d. Got %d", http.StatusServiceUnavailable, code)
+	}
+	<-stopped
+}
+
+func TestSecondSignalForcesShutdown(t *testing.T) {
+	c := make(chan os.Signal, 1)
+
+	server, l, err := createLocalListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	killed := make(chan int, 1)
+	srv := &Server{
+		Server:            server,
+		interrupt:         c,
+		ConnectionsKilled: func(n int) { killed <- n },
+	}
+	go srv.Serve(l)
+
+	go func() {
+		if r, err := http.Get("http://" + l.Addr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+
+	select {
+	case n := <-killed:
+		if n != 1 {
+			t.Errorf("Expected 1 connection to be killed. Got %d", n)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the second signal to force shutdown")
+	}
+}
+
+func TestIdleConnectionsClosedOnShutdown(t *testing.T) {
+	server, l, err := createLocalListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	// leave a keep-alive connection idle in the client's pool
+	client := http.Client{Transport: &http.Transport{}}
+	r, err := client.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, r.Body)
+	r.Body.Close()
+
+	srv.Stop(0)
+
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Idle keep-alive connection was not closed on shutdown")
+	}
+}
+
+func TestActiveConnections(t *testing.T) {
+	server, l, err := createLocalListener(killTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	if n := srv.ActiveConnections(); n != 0 {
+		t.Fatalf("Expected 0 connections before serving. Got %d", n)
+	}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := http.Get("http://" + l.Addr().String())
+			if err != nil {
+				t.Error("Error on Get:", err)
+				return
+			}
+			r.Body.Close()
+			if r.StatusCode != http.StatusOK {
+				t.Errorf("Incorrect status code on response. Expected %d. Got %d", http.StatusOK, r.StatusCode)
+			}
+		}()
+	}
+	time.Sleep(waitTime)
+
+	if n := srv.ActiveConnections(); n != 4 {
+		t.Errorf("Expected 4 active connections. Got %d", n)
+	}
+
+	srv.Stop(killTime)
+	<-stopped
+	if n := srv.ActiveConnections(); n != 0 {
+		t.Errorf("Expected 0 connections after stopping. Got %d", n)
+	}
+	wg.Wait()
+}
+
+func TestDrainTimeoutErrorRemaining(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			time.Sleep(timeoutTime)
+		})},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: graceful\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	err = <-errc
+	var timeoutErr *DrainTimeoutError
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, ErrDrainTimeout) {
+		t.Fatalf("Expected a DrainTimeoutError. Got %v", err)
+	}
+	if len(timeoutErr.Remaining) != 1 {
+		t.Fatalf("Expected 1 remaining connection. Got %+v", timeoutErr.Remaining)
+	}
+	left := timeoutErr.Remaining[0]
+	if left.ID != 1 || left.State != http.StateActive || left.RemoteAddr.String() != conn.LocalAddr().String() {
+		t.Errorf("Unexpected remaining connection %+v", left)
+	}
+	if left.Active < killTime {
+		t.Errorf("Expected the connection to have been active for at least %v. Got %v", killTime, left.Active)
+	}
+}
+
+func TestDrainPreview(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				close(started)
+				<-release
+			}
+		})},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+	addr := srv.ListenerAddr().String()
+
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	br := bufio.NewReader(idle)
+	for i := 0; i < 5; i++ {
+		if _, err := io.WriteString(idle, "GET / HTTP/1.1\r\nHost: graceful\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		r, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+	}
+
+	slow, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	if _, err := io.WriteString(slow, "GET /slow HTTP/1.1\r\nHost: graceful\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	time.Sleep(waitTime)
+
+	preview := srv.DrainPreview()
+	if preview.Timeout != killTime || preview.RecentRequests != 5 {
+		t.Errorf("Expected a timeout of %v based on 5 requests. Got %+v", killTime, preview)
+	}
+	if len(preview.Connections) != 2 {
+		t.Fatalf("Expected 2 connections. Got %+v", preview.Connections)
+	}
+	if c := preview.Connections[0]; c.State != http.StateIdle || c.RemoteAddr.String() != idle.LocalAddr().String() {
+		t.Errorf("Expected the idle connection first. Got %+v", c)
+	}
+	if c := preview.Connections[1]; c.State != http.StateActive || c.Active < waitTime {
+		t.Errorf("Expected the slow connection to have been active for at least %v. Got %+v", waitTime, c)
+	}
+	if len(preview.AtRisk) != 1 || preview.AtRisk[0].RemoteAddr.String() != slow.LocalAddr().String() {
+		t.Errorf("Expected only the slow connection at risk. Got %+v", preview.AtRisk)
+	}
+	if srv.IsShuttingDown() {
+		t.Error("Expected the preview not to initiate a shutdown")
+	}
+
+	srv.Timeout = 0
+	if preview := srv.DrainPreview(); len(preview.AtRisk) != 0 {
+		t.Errorf("Expected no connection at risk without a timeout. Got %+v", preview.AtRisk)
+	}
+
+	close(release)
+	srv.Stop(killTime)
+	<-stopped
+}
+
+func TestShutdownFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shutdown")
+	srv := &Server{
+		Timeout:              killTime,
+		NoSignalHandling:     true,
+		ShutdownFile:         path,
+		ShutdownFileInterval: 10 * time.Millisecond,
+		Server:               &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	time.Sleep(waitTime)
+	if srv.IsShuttingDown() {
+		t.Fatal("Expected the server to keep serving while the file is missing")
+	}
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for the file to shut the server down")
+	}
+}
+
+func TestShutdownFileLeftInPlace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shutdown")
+	if err := os.WriteFile(path, []byte("stop"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Timeout:              killTime,
+		NoSignalHandling:     true,
+		ShutdownFile:         path,
+		ShutdownFileInterval: 10 * time.Millisecond,
+		Server:               &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	time.Sleep(waitTime)
+	if srv.IsShuttingDown() {
+		t.Fatal("Expected a file which existed before serving not to shut the server down")
+	}
+	if err := os.WriteFile(path, []byte("stop again"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for the changed file to shut the server down")
+	}
+}
+
+func TestNoConnectionTracking(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := &Server{
+		Timeout:              killTime,
+		NoSignalHandling:     true,
+		NoConnectionTracking: true,
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-release
+		})},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + srv.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+	if n := srv.ActiveConnections(); n != 0 {
+		t.Errorf("Expected no connections to be tracked. Got %d", n)
+	}
+
+	start := time.Now()
+	srv.Stop(killTime)
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for the server to stop")
+	}
+	if elapsed := time.Since(start); elapsed >= killTime {
+		t.Errorf("Expected the request in flight not to be waited for. Took %v", elapsed)
+	}
+}
+
+func TestConnectionStateCycle(t *testing.T) {
+	srv := &Server{Server: &http.Server{}}
+	srv.connections = map[net.Conn]connInfo{}
+	srv.hijacked = map[net.Conn]uint64{}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	defer conn.Close()
+
+	steps := []struct {
+		state http.ConnState
+		count int
+	}{
+		{http.StateNew, 1},
+		{http.StateActive, 1},
+		{http.StateIdle, 1},
+		{http.StateActive, 1},
+		{http.StateIdle, 1},
+		{http.StateClosed, 0},
+		{http.StateClosed, 0},
+		{http.StateIdle, 0},
+		{http.StateActive, 0},
+	}
+	for i, step := range steps {
+		srv.trackConnection(conn, step.state)
+		if n := srv.ActiveConnections(); n != step.count {
+			t.Fatalf("Expected %d connections after step %d (%v). Got %d", step.count, i, step.state, n)
+		}
+		if id, ok := srv.ConnectionID(conn); step.count == 1 && (!ok || id != 1) {
+			t.Fatalf("Expected the connection to keep ID 1 after step %d (%v). Got %d", i, step.state, id)
+		}
+	}
+	if n := srv.TotalConnections(); n != 1 {
+		t.Errorf("Expected 1 connection in total. Got %d", n)
+	}
+}
+
+func TestTotalConnections(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	for run := 1; run <= 2; run++ {
+		stopped := srv.StopChan()
+		go srv.ListenAndServe()
+		<-srv.Ready()
+
+		for i := 0; i < 3; i++ {
+			r, err := client.Get("http://" + srv.ListenerAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Body.Close()
+		}
+
+		if n := srv.TotalConnections(); n != uint64(3*run) {
+			t.Errorf("Expected %d connections accepted in total. Got %d", 3*run, n)
+		}
+		srv.Stop(killTime)
+		<-stopped
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graceful.sock")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	srv := &Server{
+		Timeout:          killTime,
+		Network:          "unix",
+		Server:           &http.Server{Addr: path, Handler: mux},
+		NoSignalHandling: true,
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	time.Sleep(waitTime)
+
+	client := http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	r, err := client.Get("http://graceful/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	srv.Stop(killTime)
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+
+	// ListenAndServe removes the socket after the stop channel is closed
+	time.Sleep(waitTime)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the socket file to be removed. Got %v", err)
+	}
+}
+
+func TestUnlinkOnShutdown(t *testing.T) {
+	keep, unlink := false, true
+	for _, tt := range []struct {
+		name     string
+		unlink   *bool
+		passed   bool
+		expected bool
+	}{
+		{name: "created", expected: true},
+		{name: "created, kept", unlink: &keep, expected: false},
+		{name: "passed", passed: true, expected: false},
+		{name: "passed, unlinked", unlink: &unlink, passed: true, expected: true},
+	} {
+		path := filepath.Join(t.TempDir(), "graceful.sock")
+		srv := &Server{
+			Timeout:          killTime,
+			Network:          "unix",
+			UnlinkOnShutdown: tt.unlink,
+			Server:           &http.Server{Addr: path, Handler: http.NewServeMux()},
+			NoSignalHandling: true,
+		}
+		done := make(chan error, 1)
+		if tt.passed {
+			// Listeners from socket activation do not remove their file
+			// when closed.
+			l, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			go func() { done <- srv.Serve(l) }()
+		} else {
+			go func() { done <- srv.ListenAndServe() }()
+		}
+		<-srv.Ready()
+
+		srv.Stop(killTime)
+		if err := <-done; err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		_, err := os.Stat(path)
+		if removed := os.IsNotExist(err); removed != tt.expected {
+			t.Errorf("%s: expected the socket file to be removed to be %v. Got %v", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestNetworkTCP4(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		Network:          "tcp4",
+		Server:           &http.Server{Addr: ":0", Handler: http.NewServeMux()},
+		NoSignalHandling: true,
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+	_, port, _ := net.SplitHostPort(srv.ListenerAddr().String())
+
+	conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conn, err := net.Dial("tcp6", net.JoinHostPort("::1", port)); err == nil {
+		conn.Close()
+		t.Error("Expected the server not to accept IPv6 connections")
+	}
+
+	srv.Stop(killTime)
+	<-stopped
+}
+
+func TestListenConfig(t *testing.T) {
+	controlled := make(chan string, 1)
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		ListenConfig: &net.ListenConfig{
+			Control: func(network, address string, c syscall.RawConn) error {
+				controlled <- network
+				return nil
+			},
+		},
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	select {
+	case network := <-controlled:
+		if network != "tcp4" {
+			t.Errorf("Expected Control to be called for tcp4. Got %s", network)
+		}
+	default:
+		t.Error("Expected the listener to be created with ListenConfig")
+	}
+
+	srv.Stop(killTime)
+	<-stopped
+}
+
+func TestInterruptChannelClosedExternally(t *testing.T) {
+	c := make(chan os.Signal, 1)
+
+	server, l, err := createLocalListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server, interrupt: c}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	close(c)
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+	srv.Stop(killTime)
+}
+
+func TestRapidSignalsDuringShutdown(t *testing.T) {
+	c := make(chan os.Signal, 1)
+
+	server, l, err := createLocalListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server, interrupt: c}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	c <- syscall.SIGINT
+	for i := 0; i < 8; i++ {
+		go srv.Stop(killTime)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+}
+
+func TestConnectionTimeout(t *testing.T) {
+	server, l, err := createLocalListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	killed := make(chan int, 1)
+	srv := &Server{
+		Timeout:           killTime * 10,
+		ConnectionTimeout: killTime / 2,
+		Server:            server,
+		NoSignalHandling:  true,
+		ConnectionsKilled: func(n int) { killed <- n },
+	}
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if r, err := http.Get("http://" + l.Addr().String()); err == nil {
+			r.Body.Close()
+			t.Error("Expected the stalled connection to be closed")
+		}
+	}()
+	time.Sleep(waitTime)
+	srv.Stop(killTime * 10)
+
+	select {
+	case n := <-killed:
+		if n != 0 {
+			t.Errorf("Expected the stalled connection to be closed before the timeout. %d were killed", n)
+		}
+	case <-time.After(killTime * 2):
+		t.Fatal("ConnectionTimeout did not close the stalled connection")
+	}
+	wg.Wait()
+}
+
+func TestSafeRequestTimeout(t *testing.T) {
+	type key struct{}
+	srv := &Server{
+		Timeout:            timeoutTime * 2,
+		SafeRequestTimeout: waitTime * 2,
+		NoSignalHandling:   true,
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				if r.Context().Value(key{}) != "conn" {
+					t.Error("Expected the server's ConnContext to be preserved")
+				}
+				time.Sleep(timeoutTime)
+			}),
+			ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+				return context.WithValue(ctx, key{}, "conn")
+			},
+		},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	results := make(map[string]chan error)
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		errc := make(chan error, 1)
+		results[method] = errc
+		go func(method string) {
+			req, _ := http.NewRequest(method, "http://"+srv.ListenerAddr().String(), nil)
+			r, err := http.DefaultClient.Do(req)
+			if err == nil {
+				r.Body.Close()
+			}
+			errc <- err
+		}(method)
+	}
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.Stop(srv.Timeout)
+
+	if err := <-results[http.MethodGet]; err == nil {
+		t.Error("Expected the GET request to be closed early")
+	}
+	if elapsed := time.Since(start); elapsed > killTime {
+		t.Errorf("Expected the GET connection to be closed after SafeRequestTimeout. Took %v", elapsed)
+	}
+	if err := <-results[http.MethodPost]; err != nil {
+		t.Error("Expected the POST request to be given the whole timeout:", err)
+	}
+	<-stopped
+}
+
+func TestDrainReadTimeout(t *testing.T) {
+	readErrs := make(chan error, 2)
+	srv := &Server{
+		Timeout:          timeoutTime * 5,
+		DrainReadTimeout: waitTime * 2,
+		NoSignalHandling: true,
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				_, err := io.ReadAll(r.Body)
+				readErrs <- err
+				if err != nil {
+					rw.WriteHeader(http.StatusRequestTimeout)
+					return
+				}
+				// The deadline no longer applies once the body is read.
+				time.Sleep(killTime)
+				if r.Context().Err() != nil {
+					t.Error("Expected the request context not to be cancelled")
+				}
+			}),
+		},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	uploaded := make(chan error, 1)
+	go func() {
+		r, err := http.Post("http://"+srv.ListenerAddr().String(), "text/plain", strings.NewReader("upload"))
+		if err == nil {
+			r.Body.Close()
+			if r.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status %d", r.StatusCode)
+			}
+		}
+		uploaded <- err
+	}()
+
+	stalled, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	stalled.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1000\r\n\r\npartial"))
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.Stop(srv.Timeout)
+
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime * 2):
+		t.Fatal("Expected the stalled upload not to hold up the shutdown")
+	}
+	if elapsed := time.Since(start); elapsed >= srv.Timeout {
+		t.Errorf("Expected the shutdown to finish before the timeout. Took %v", elapsed)
+	}
+	if err := <-uploaded; err != nil {
+		t.Error("Expected the finished upload to be served:", err)
+	}
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if err := <-readErrs; err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("Expected only the stalled upload to fail. %d failed", failed)
+	}
+}
+
+func TestListenerAddr(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	if addr := srv.ListenerAddr(); addr != nil {
+		t.Fatalf("Expected no address before listening. Got %v", addr)
+	}
+
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	addr := srv.ListenerAddr()
+	if addr == nil {
+		t.Fatal("Expected an address once listening")
+	}
+	if strings.HasSuffix(addr.String(), ":0") {
+		t.Fatalf("Expected the port chosen by the system. Got %v", addr)
+	}
+
+	r, err := http.Get("http://" + addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	srv.Stop(killTime)
+	<-stopped
+}
+
+func TestReady(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	ready := srv.Ready()
+
+	select {
+	case <-ready:
+		t.Fatal("Expected the server not to be ready before serving")
+	default:
+	}
+
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+
+	select {
+	case <-ready:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for the server to be ready")
+	}
+
+	// no sleep: the server must accept connections as soon as it is ready
+	r, err := http.Get("http://" + srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	srv.Stop(killTime)
+	<-stopped
+}
+
+func TestMaxConnections(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		MaxConnections:   1,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+	addr := srv.ListenerAddr().String()
+
+	held, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitTime)
+
+	if _, err := http.Get("http://" + addr); err == nil {
+		t.Error("Expected connections over the limit to be closed")
+	}
+	if n := srv.ActiveConnections(); n != 1 {
+		t.Errorf("Expected 1 managed connection. Got %d", n)
+	}
+
+	held.Close()
+	time.Sleep(waitTime)
+
+	r, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal("Expected connections to be accepted below the limit:", err)
+	}
+	r.Body.Close()
+
+	srv.Stop(killTime)
+	<-stopped
+}
+
+func TestShutdownDelay(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		ShutdownDelay:    killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+	addr := srv.ListenerAddr().String()
+
+	srv.Stop(killTime)
+	select {
+	case <-srv.ShuttingDown():
+	case <-time.After(waitTime):
+		t.Fatal("Expected shutdown to be initiated before the delay")
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Expected connections to be accepted during the delay:", err)
+	}
+	c.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(killTime + timeoutTime):
+		t.Fatal("Timed out waiting for the server to stop")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Expected the listener to be closed after the delay")
+	}
+}
+
+func TestIsShuttingDown(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		ShutdownDelay:    killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	if srv.IsShuttingDown() {
+		t.Fatal("Expected the server not to be shutting down yet")
+	}
+	srv.Stop(killTime)
+	<-srv.ShuttingDown()
+	if !srv.IsShuttingDown() {
+		t.Error("Expected the server to be shutting down during the delay")
+	}
+	<-stopped
+}
+
+func TestDrainContext(t *testing.T) {
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	ctx := srv.DrainContext()
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	if ctx.Err() != nil {
+		t.Fatal("Expected the drain context not to be done before shutdown")
+	}
+	srv.Stop(killTime)
+	select {
+	case <-ctx.Done():
+	case <-time.After(waitTime):
+		t.Fatal("Expected the drain context to be done once shutdown started")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Errorf("Expected %v. Got %v", context.Canceled, ctx.Err())
+	}
+	<-stopped
+}
+
+func TestDrainContextDeadline(t *testing.T) {
+	closed := make(chan time.Time, 1)
+	srv := &Server{
+		ShutdownDelay:    waitTime,
+		NoSignalHandling: true,
+		OnListenerClosed: func() { closed <- time.Now() },
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	ctx := srv.DrainContext()
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("Expected no deadline before shutdown")
+	}
+	initiated := time.Now()
+	srv.Stop(killTime)
+	<-ctx.Done()
+
+	// During the ShutdownDelay, the deadline is that of the drain to come.
+	want := initiated.Add(waitTime + killTime)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("Expected a deadline once shutdown started")
+	}
+	if d := deadline.Sub(want); d < -waitTime/2 || d > waitTime/2 {
+		t.Errorf("Expected a deadline around %v. Got %v", want, deadline)
+	}
+
+	// Once the drain has started, it is Timeout after the listener closed.
+	want = (<-closed).Add(killTime)
+	deadline, _ = ctx.Deadline()
+	if d := deadline.Sub(want); d < -waitTime/2 || d > 0 {
+		t.Errorf("Expected a deadline just before %v. Got %v", want, deadline)
+	}
+	<-stopped
+}
+
+func TestDrainContextNoDeadline(t *testing.T) {
+	srv := &Server{
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	ctx := srv.DrainContext()
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	srv.Stop(0)
+	<-ctx.Done()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("Expected no deadline without a Timeout")
+	}
+	<-stopped
+}
+
+func TestShutdownJitter(t *testing.T) {
+	srv := &Server{
+		ShutdownDelay:  killTime,
+		ShutdownJitter: timeoutTime,
+		JitterSource:   mrand.NewSource(1),
+	}
+	want := killTime + time.Duration(mrand.New(mrand.NewSource(1)).Int63n(int64(timeoutTime)))
+	if delay := srv.shutdownDelay(); delay != want {
+		t.Errorf("Expected a delay of %v. Got %v", want, delay)
+	}
+
+	srv.JitterSource = nil
+	for i := 0; i < 10; i++ {
+		if delay := srv.shutdownDelay(); delay < killTime || delay >= killTime+timeoutTime {
+			t.Fatalf("Expected a delay between %v and %v. Got %v", killTime, killTime+timeoutTime, delay)
+		}
+	}
+}
+
+func TestServeListeners(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(timeoutTime)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	killed := make(chan int, 1)
+	srv := &Server{
+		Timeout:           killTime,
+		NoSignalHandling:  true,
+		ConnectionsKilled: func(n int) { killed <- n },
+		Server:            &http.Server{Handler: mux},
+	}
+	stopped := srv.StopChan()
+	go srv.ServeListeners(listeners...)
+	<-srv.Ready()
+
+	for _, l := range listeners {
+		go func(addr string) {
+			if r, err := http.Get("http://" + addr); err == nil {
+				r.Body.Close()
+			}
+		}(l.Addr().String())
+	}
+	time.Sleep(waitTime)
+
+	if n := srv.ActiveConnections(); n != 2 {
+		t.Errorf("Expected 2 connections across both listeners. Got %d", n)
+	}
+
+	srv.Stop(killTime)
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for the server to stop")
+	}
+
+	if n := <-killed; n != 2 {
+		t.Errorf("Expected connections from both listeners to be killed. Got %d", n)
+	}
+	for _, l := range listeners {
+		if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			t.Errorf("Expected %v to be closed", l.Addr())
+		}
+	}
+}
+
+// isNetTimeout reports whether err is a network timeout.
+func isNetTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestImmediateClose(t *testing.T) {
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-release
+			io.WriteString(rw, "done")
+		})},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ServeListeners(public, ImmediateClose(admin)) }()
+	<-srv.Ready()
+
+	dial := func(l net.Listener) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: graceful\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	publicConn, adminConn := dial(public), dial(admin)
+	defer publicConn.Close()
+	defer adminConn.Close()
+	time.Sleep(waitTime)
+
+	if n := srv.ActiveConnections(); n != 1 {
+		t.Errorf("Expected only the public connection to be managed. Got %d", n)
+	}
+	if n := srv.TotalConnections(); n != 2 {
+		t.Errorf("Expected both connections to be counted. Got %d", n)
+	}
+
+	srv.Stop(timeoutTime)
+	adminConn.SetReadDeadline(time.Now().Add(killTime))
+	if _, err := adminConn.Read(make([]byte, 1)); err == nil || isNetTimeout(err) {
+		t.Errorf("Expected the admin connection to be closed at once. Got %v", err)
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("Expected the public connection to be drained. Got %v", err)
+	default:
+	}
+
+	close(release)
+	r, err := http.ReadResponse(bufio.NewReader(publicConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Expected a clean shutdown. Got %v", err)
+	}
+}
+
+func TestMaxShutdownTimeCompressesDrain(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var buf bytes.Buffer
+	srv := &Server{
+		NoSignalHandling: true,
+		MaxShutdownTime:  killTime,
+		KillGrace:        waitTime,
+		Logger:           log.New(&buf, "", 0),
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-release
+		})},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: graceful\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitTime)
+
+	// With no Timeout, the drain would otherwise wait for the request.
+	start := time.Now()
+	srv.Stop(0)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrDrainTimeout) {
+			t.Errorf("Expected ErrDrainTimeout. Got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected the shutdown to finish within MaxShutdownTime")
+	}
+	if elapsed := time.Since(start); elapsed < killTime-waitTime {
+		t.Errorf("Expected the drain to take most of MaxShutdownTime. Took %v", elapsed)
+	}
+	if !strings.Contains(buf.String(), "compressing drain timeout") {
+		t.Errorf("Expected the compression to be logged. Got %q", buf.String())
+	}
+}
+
+func TestMaxShutdownTimeCompressesEviction(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var buf bytes.Buffer
+	srv := &Server{
+		NoSignalHandling: true,
+		MaxShutdownTime:  killTime,
+		EvictAge:         time.Millisecond,
+		Logger:           log.New(&buf, "", 0),
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-release
+		})},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: graceful\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitTime)
+
+	// The connection is evicted in the last tenth of the compressed drain,
+	// rather than killed once MaxShutdownTime has passed.
+	srv.Stop(2 * timeoutTime)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Expected the connection to be evicted rather than killed. Got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected the shutdown to finish within MaxShutdownTime")
+	}
+	if !strings.Contains(buf.String(), "evicting connection") {
+		t.Errorf("Expected the connection to be evicted. Got %q", buf.String())
+	}
+}
+
+func TestMaxShutdownTimeCompressesDelay(t *testing.T) {
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		ShutdownDelay:    timeoutTime,
+		KillGrace:        timeoutTime,
+		MaxShutdownTime:  killTime,
+		Logger:           log.New(&buf, "", 0),
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	listenerClosed := make(chan time.Time, 1)
+	srv.OnListenerClosed = func() { listenerClosed <- time.Now() }
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	start := time.Now()
+	srv.Stop(timeoutTime)
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected the shutdown to finish within MaxShutdownTime")
+	}
+	if closed := (<-listenerClosed).Sub(start); closed < killTime/2-waitTime || closed > killTime/2+waitTime {
+		t.Errorf("Expected the delay to be halved to fit with KillGrace. Listeners closed after %v", closed)
+	}
+	if !strings.Contains(buf.String(), "compressing shutdown delay") {
+		t.Errorf("Expected the compression to be logged. Got %q", buf.String())
+	}
+}
+
+func TestMaxShutdownTimeCompressesKillGrace(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var buf bytes.Buffer
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		ShutdownDelay:    killTime,
+		KillGrace:        timeoutTime,
+		MaxShutdownTime:  timeoutTime,
+		Logger:           log.New(&buf, "", 0),
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-release
+		})},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: graceful\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.Stop(timeoutTime)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrDrainTimeout) {
+			t.Errorf("Expected ErrDrainTimeout. Got %v", err)
+		}
+	case <-time.After(2 * timeoutTime):
+		t.Fatal("Expected the shutdown to finish within MaxShutdownTime")
+	}
+	if elapsed := time.Since(start); elapsed > timeoutTime+waitTime/2 {
+		t.Errorf("Expected the shutdown to take at most %v. Took %v", timeoutTime, elapsed)
+	}
+	if stats, _ := srv.LastShutdown(); stats.Shutdown > timeoutTime+waitTime/2 {
+		t.Errorf("Expected the shutdown to be reported within %v. Got %v", timeoutTime, stats.Shutdown)
+	}
+	if !strings.Contains(buf.String(), "compressing kill grace from 1s to 666.666666ms") {
+		t.Errorf("Expected the kill grace to be scaled down with the delay. Got %q", buf.String())
+	}
+}
+
+func TestImmediateCloseWithoutConnectionTracking(t *testing.T) {
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Timeout:              killTime,
+		NoSignalHandling:     true,
+		NoConnectionTracking: true,
+		Server:               &http.Server{Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.ServeListeners(ImmediateClose(admin))
+	<-srv.Ready()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < 5; i++ {
+		r, err := client.Get("http://" + admin.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+	}
+
+	srv.connLock.Lock()
+	n := len(srv.immediate)
+	srv.connLock.Unlock()
+	if n != 0 {
+		t.Errorf("Expected no connections to be recorded without tracking. Got %d", n)
+	}
+	srv.Stop(killTime)
+	<-stopped
+}
+
+// connsListener returns conns from Accept, then err.
+type connsListener struct {
+	net.Listener
+	conns chan net.Conn
+	err   error
+}
+
+func (l connsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	default:
+		return nil, l.err
+	}
+}
+
+func TestImmediateCloseLateAccept(t *testing.T) {
+	late, peer := net.Pipe()
+	defer peer.Close()
+	conns := make(chan net.Conn, 1)
+	conns <- late
+	closedErr := errors.New("listener closed")
+
+	srv := &Server{}
+	srv.immediate = map[net.Conn]struct{}{}
+	srv.drained = make(chan struct{})
+	l := immediateListener{connsListener{conns: conns, err: closedErr}, srv}
+
+	if conn, err := l.Accept(); conn != nil || err != closedErr {
+		t.Errorf("Expected a connection accepted while draining not to be returned. Got %v, %v", conn, err)
+	}
+	peer.SetReadDeadline(time.Now().Add(killTime))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the late connection to be closed. Got %v", err)
+	}
+}
+
+func TestServeListenersRequiresListener(t *testing.T) {
+	srv := &Server{Server: &http.Server{}}
+	if err := srv.ServeListeners(); err == nil {
+		t.Fatal("Expected an error when serving no listeners")
+	}
+}
+
+func TestNewConnectionsDrain(t *testing.T) {
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(waitTime)
+
+	srv.Stop(timeoutTime)
+	<-srv.ShuttingDown()
+	time.Sleep(waitTime)
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	r, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Expected the request on the new connection to be served. Got %v", err)
+	}
+	r.Body.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(killTime):
+		t.Fatal("Expected the server to stop once the connection was served")
+	}
+}
+
+func TestDrainKeepAlives(t *testing.T) {
+	for _, drain := range []bool{false, true} {
+		srv := &Server{
+			Timeout:          killTime,
+			ShutdownDelay:    killTime,
+			DrainKeepAlives:  drain,
+			NoSignalHandling: true,
+			Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+		}
+		stopped := srv.StopChan()
+		go srv.ListenAndServe()
+		<-srv.Ready()
+
+		srv.Stop(killTime)
+		<-srv.ShuttingDown()
+
+		r, err := http.Get("http://" + srv.ListenerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.Close != drain {
+			t.Errorf("DrainKeepAlives %v: expected Connection: close to be %v during the delay", drain, drain)
+		}
+
+		<-stopped
+	}
+}
+
+func TestDrainKeepAlivesClosesInFlightResponses(t *testing.T) {
+	started := make(chan struct{})
+	srv := &Server{
+		Timeout:          timeoutTime,
+		ShutdownDelay:    killTime,
+		DrainKeepAlives:  true,
+		NoSignalHandling: true,
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				close(started)
+				time.Sleep(waitTime * 2)
+			}
+		})},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	r, err := http.Get("http://" + srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.Close {
+		t.Error("Expected connections to be kept alive before shutdown")
+	}
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		r, err := http.Get("http://" + srv.ListenerAddr().String() + "/slow")
+		if err != nil {
+			t.Error(err)
+			close(responses)
+			return
+		}
+		r.Body.Close()
+		responses <- r
+	}()
+	<-started
+	srv.Stop(timeoutTime)
+
+	if r := <-responses; r != nil && !r.Close {
+		t.Error("Expected the in-flight response to carry Connection: close")
+	}
+	<-stopped
+}
+
+// slowCloseListener keeps Accept blocked for a while after it is closed,
+// delaying the return of Serve.
+type slowCloseListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l slowCloseListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		time.Sleep(l.delay)
+	}
+	return c, err
+}
+
+func TestTimeoutStartsWhenListenerCloses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(timeoutTime * 2)
+	})
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server:           &http.Server{Handler: mux},
+	}
+	stopped := srv.StopChan()
+	go srv.Serve(slowCloseListener{l, killTime})
+	<-srv.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + l.Addr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.Stop(killTime)
+	<-stopped
+
+	// Serve returns killTime after the listener is closed, so measuring the
+	// timeout from then would take twice as long.
+	if elapsed := time.Since(start); elapsed > killTime+killTime/2 {
+		t.Errorf("Expected the timeout to start when the listener closed. Took %v", elapsed)
+	}
+}
+
+func BenchmarkConnState(b *testing.B) {
+	benchmarkConnState(b, false)
+}
+
+// BenchmarkConnStateUntracked measures the same transitions without
+// connection tracking, to show what the tracking costs.
+func BenchmarkConnStateUntracked(b *testing.B) {
+	benchmarkConnState(b, true)
+}
+
+func benchmarkConnState(b *testing.B, untracked bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	srv := &Server{
+		NoSignalHandling:     true,
+		NoConnectionTracking: untracked,
+		Logger:               log.New(io.Discard, "", 0),
+		Server:               &http.Server{Handler: http.NewServeMux()},
+	}
+	stopped := srv.StopChan()
+	go srv.Serve(l)
+	<-srv.Ready()
+	connState := srv.Server.ConnState
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		for pb.Next() {
+			connState(server, http.StateNew)
+			connState(server, http.StateActive)
+			connState(server, http.StateIdle)
+			connState(server, http.StateClosed)
+		}
+	})
+	b.StopTimer()
+
+	srv.Stop(0)
+	<-stopped
+}
+
+// BenchmarkServeHTTP measures the per-request cost the Server adds in front
+// of the handler.
+func BenchmarkServeHTTP(b *testing.B) {
+	srv := &Server{
+		NoSignalHandling: true,
+		Logger:           log.New(io.Discard, "", 0),
+		Server:           &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		for pb.Next() {
+			srv.serveHTTP(rw, r)
+		}
+	})
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package graceful
+
+import (
+	"os"
+	"syscall"
+)
+
+// defaultSignals are the signals which initiate a graceful shutdown when
+// Server.Signals is empty.
+var defaultSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
@@ -0,0 +1,7 @@
+package graceful
+
+import "os"
+
+// defaultSignals are the signals which initiate a graceful shutdown when
+// Server.Signals is empty. Windows only delivers os.Interrupt.
+var defaultSignals = []os.Signal{os.Interrupt}
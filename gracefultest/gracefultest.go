@@ -0,0 +1,173 @@
+// Package gracefultest provides utilities for testing the graceful shutdown
+// of HTTP servers, in the same way as net/http/httptest does for serving.
+package gracefultest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/tylerb/graceful"
+)
+
+// DefaultTimeout is the Timeout given to servers created by NewServer and
+// NewUnstartedServer, so that a test cannot hang on a request which never
+// finishes.
+var DefaultTimeout = 5 * time.Second
+
+// Server is a graceful.Server listening on a system-chosen port on the
+// loopback interface, for use in end-to-end shutdown tests.
+//
+// Example:
+//	ts := gracefultest.NewServer(handler)
+//	go http.Get(ts.URL + "/slow")
+//	ts.TriggerShutdown()
+//	err := ts.Wait()
+type Server struct {
+	// URL is the base URL of the server, of the form http://ipaddr:port
+	// with no trailing slash.
+	URL string
+
+	// Config may be changed after calling NewUnstartedServer and before
+	// Start. Signal handling is disabled, so the test process is never
+	// signalled; shutdown is triggered with TriggerShutdown instead.
+	Config *graceful.Server
+
+	// done is closed once serving has returned, with its error in err.
+	done chan struct{}
+	err  error
+}
+
+// NewServer starts and returns a new Server serving h. The caller should
+// call Close or Wait when finished, to shut it down.
+func NewServer(h http.Handler) *Server {
+	ts := NewUnstartedServer(h)
+	ts.Start()
+	return ts
+}
+
+// NewUnstartedServer returns a new Server serving h, but doesn't start it.
+// After changing its configuration, the caller should call Start.
+func NewUnstartedServer(h http.Handler) *Server {
+	return &Server{
+		Config: &graceful.Server{
+			Timeout:          DefaultTimeout,
+			NoSignalHandling: true,
+			Server:           &http.Server{Handler: h},
+		},
+	}
+}
+
+// Start starts the server from NewUnstartedServer, returning once it is
+// accepting connections. It panics if the server cannot listen.
+func (ts *Server) Start() {
+	if ts.done != nil {
+		panic("gracefultest: Server already started")
+	}
+	ts.Config.Addr = "127.0.0.1:0"
+	ts.Config.NoSignalHandling = true
+	ts.done = make(chan struct{})
+	ready := ts.Config.Ready()
+	go func() {
+		defer close(ts.done)
+		ts.err = ts.Config.ListenAndServe()
+	}()
+
+	select {
+	case <-ready:
+	case <-ts.done:
+		panic(fmt.Sprintf("gracefultest: failed to serve: %v", ts.err))
+	}
+	ts.URL = "http://" + ts.Config.ListenerAddr().String()
+}
+
+// TriggerShutdown begins a graceful shutdown, as a signal would, with the
+// server's Timeout. It does not wait for the shutdown to finish.
+func (ts *Server) TriggerShutdown() {
+	ts.Config.Stop(ts.Config.Timeout)
+}
+
+// Wait blocks until the server has drained its connections and stopped,
+// returning the error from serving, which matches graceful.ErrDrainTimeout
+// if connections had to be closed when the timeout expired.
+func (ts *Server) Wait() error {
+	<-ts.done
+	return ts.err
+}
+
+// Close shuts the server down and waits for it to stop.
+func (ts *Server) Close() {
+	ts.TriggerShutdown()
+	_ = ts.Wait() // callers wanting the error call Wait instead.
+}
+
+// VerifyDrain checks that srv drains an in-flight request rather than
+// dropping it. It serves srv on a system-chosen loopback port, replacing its
+// handler with one which takes latency to respond, shuts srv down while a
+// request is being served, and returns an error unless the request completed
+// with a 200 response and serving stopped cleanly. The request is written
+// directly to the connection, so that a reset is not hidden by a client
+// retrying it. srv must not already be serving, and should not be reused
+// afterwards.
+func VerifyDrain(srv *graceful.Server, latency time.Duration) error {
+	started := make(chan struct{})
+	if srv.Server == nil {
+		srv.Server = &http.Server{}
+	}
+	srv.Addr = "127.0.0.1:0"
+	srv.NoSignalHandling = true
+	srv.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(latency)
+		io.WriteString(rw, "drained")
+	})
+
+	done := make(chan error, 1)
+	ready := srv.Ready()
+	go func() { done <- srv.ListenAndServe() }()
+	select {
+	case <-ready:
+	case err := <-done:
+		return fmt.Errorf("gracefultest: failed to serve: %w", err)
+	}
+
+	conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+	if err != nil {
+		srv.Stop(srv.Timeout)
+		<-done
+		return fmt.Errorf("gracefultest: failed to connect: %w", err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: gracefultest\r\n\r\n"); err != nil {
+		srv.Stop(srv.Timeout)
+		<-done
+		return fmt.Errorf("gracefultest: failed to send the request: %w", err)
+	}
+
+	select {
+	case <-started:
+	case err := <-done:
+		return fmt.Errorf("gracefultest: serving stopped before the request was handled: %v", err)
+	}
+	srv.Stop(srv.Timeout)
+
+	r, readErr := http.ReadResponse(bufio.NewReader(conn), nil)
+	if readErr == nil {
+		_, readErr = io.ReadAll(r.Body)
+		r.Body.Close()
+	}
+	serveErr := <-done
+
+	switch {
+	case readErr != nil:
+		return fmt.Errorf("gracefultest: in-flight request was dropped: %w", readErr)
+	case r.StatusCode != http.StatusOK:
+		return fmt.Errorf("gracefultest: in-flight request failed with status %d", r.StatusCode)
+	case serveErr != nil:
+		return fmt.Errorf("gracefultest: shutdown failed: %w", serveErr)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package gracefultest
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tylerb/graceful"
+)
+
+func TestServerDrains(t *testing.T) {
+	ts := NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(rw, "done")
+	}))
+
+	errc := make(chan error, 1)
+	go func() {
+		r, err := http.Get(ts.URL)
+		if err == nil {
+			r.Body.Close()
+		}
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ts.TriggerShutdown()
+	if err := ts.Wait(); err != nil {
+		t.Fatal("Expected the shutdown to drain cleanly:", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal("Expected the request to finish:", err)
+	}
+	if _, err := http.Get(ts.URL); err == nil {
+		t.Error("Expected the server to have stopped listening")
+	}
+}
+
+func TestServerTimesOut(t *testing.T) {
+	ts := NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	ts.Config.Timeout = 100 * time.Millisecond
+	ts.Start()
+
+	go http.Get(ts.URL)
+	time.Sleep(50 * time.Millisecond)
+
+	ts.TriggerShutdown()
+	if err := ts.Wait(); !errors.Is(err, graceful.ErrDrainTimeout) {
+		t.Errorf("Expected ErrDrainTimeout. Got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ts := NewServer(http.NotFoundHandler())
+	ts.Close()
+	if err := ts.Wait(); err != nil {
+		t.Errorf("Expected no error. Got %v", err)
+	}
+}
+
+func TestVerifyDrain(t *testing.T) {
+	srv := &graceful.Server{Timeout: time.Second}
+	if err := VerifyDrain(srv, 100*time.Millisecond); err != nil {
+		t.Error("Expected the request to be drained:", err)
+	}
+}
+
+func TestVerifyDrainDetectsDroppedRequests(t *testing.T) {
+	srv := &graceful.Server{Timeout: 100 * time.Millisecond}
+	if err := VerifyDrain(srv, time.Second); err == nil {
+		t.Error("Expected an error when the request outlives the timeout")
+	}
+}
@@ -0,0 +1,99 @@
+package graceful
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// Group serves several Servers together, and shuts them down one after
+// another on a single signal, so that one server keeps serving until those
+// before it have drained. For instance, an admin server exposing metrics
+// can be kept up while the public server drains. Each server drains within
+// its own Timeout.
+//
+// Example:
+//	g := graceful.NewGroup(public, admin)
+//	err := g.ListenAndServe()
+type Group struct {
+	// Servers are the servers in the group, in the order they are shut
+	// down. Their own signal handling is disabled while the group serves.
+	Servers []*Server
+
+	// Signals are the signals which shut the group down. If empty, SIGINT
+	// and SIGTERM are used, or only os.Interrupt on Windows.
+	Signals []os.Signal
+
+	// NoSignalHandling prevents the group from handling signals, so that it
+	// is only shut down by Stop.
+	NoSignalHandling bool
+
+	// stop is created once by initOnce, and closed once by stopOnce.
+	initOnce sync.Once
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// NewGroup returns a Group shutting servers down in the order given.
+func NewGroup(servers ...*Server) *Group {
+	return &Group{Servers: servers}
+}
+
+// ListenAndServe calls ListenAndServe on every server in the group, and
+// shuts them down in order once a signal is received, Stop is called or
+// any of them stops serving on its own, for example because it failed to
+// listen. It returns once they have all stopped, with the first error
+// returned by one of them, in the group's order.
+func (g *Group) ListenAndServe() error {
+	done := make([]chan struct{}, len(g.Servers))
+	errs := make([]error, len(g.Servers))
+	exited := make(chan struct{}, len(g.Servers))
+	for i, srv := range g.Servers {
+		srv.NoSignalHandling = true
+		done[i] = make(chan struct{})
+		go func(i int, srv *Server) {
+			errs[i] = srv.ListenAndServe()
+			close(done[i])
+			exited <- struct{}{}
+		}(i, srv)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	if !g.NoSignalHandling {
+		sigs := g.Signals
+		if len(sigs) == 0 {
+			sigs = defaultSignals
+		}
+		signal.Notify(interrupt, sigs...)
+		defer signal.Stop(interrupt)
+	}
+
+	select {
+	case <-interrupt:
+	case <-g.stopChan():
+	case <-exited:
+	}
+
+	// A server stopped before it started serving has nothing to report.
+	var err error
+	for i, srv := range g.Servers {
+		srv.Stop(srv.Timeout)
+		<-done[i]
+		if err == nil && errs[i] != ErrServerStopped {
+			err = errs[i]
+		}
+	}
+	return err
+}
+
+// Stop shuts the servers in the group down in order, each with its own
+// Timeout. It is safe to call Stop more than once, and before
+// ListenAndServe.
+func (g *Group) Stop() {
+	g.stopOnce.Do(func() { close(g.stopChan()) })
+}
+
+func (g *Group) stopChan() chan struct{} {
+	g.initOnce.Do(func() { g.stop = make(chan struct{}) })
+	return g.stop
+}
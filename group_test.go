@@ -0,0 +1,88 @@
+package graceful
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupShutsDownInOrder(t *testing.T) {
+	var lock sync.Mutex
+	var order []string
+	completed := func(name string) func() {
+		return func() {
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+		}
+	}
+
+	started := make(chan struct{})
+	public := &Server{
+		Timeout:           timeoutTime,
+		ShutdownCompleted: completed("public"),
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(killTime)
+		})},
+	}
+	admin := &Server{
+		Timeout:           timeoutTime,
+		ShutdownCompleted: completed("admin"),
+		Server:            &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	g := NewGroup(public, admin)
+	g.NoSignalHandling = true
+	errc := make(chan error, 1)
+	go func() { errc <- g.ListenAndServe() }()
+	<-public.Ready()
+	<-admin.Ready()
+
+	go func() {
+		if r, err := http.Get("http://" + public.ListenerAddr().String()); err == nil {
+			r.Body.Close()
+		}
+	}()
+	<-started
+	g.Stop()
+
+	// The admin server keeps serving while the public one drains.
+	time.Sleep(waitTime)
+	r, err := http.Get("http://" + admin.ListenerAddr().String())
+	if err != nil {
+		t.Fatal("Expected the admin server to serve during the public drain:", err)
+	}
+	r.Body.Close()
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != "public" || order[1] != "admin" {
+		t.Errorf("Expected the servers to shut down in order. Got %v", order)
+	}
+}
+
+func TestGroupStopsWhenAServerFails(t *testing.T) {
+	public := &Server{
+		Timeout: killTime,
+		Server:  &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+	}
+	admin := &Server{
+		Timeout: killTime,
+		Server:  &http.Server{Addr: "127.0.0.1:-1", Handler: http.NewServeMux()},
+	}
+	g := NewGroup(public, admin)
+	g.NoSignalHandling = true
+
+	errc := make(chan error, 1)
+	go func() { errc <- g.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Expected the listen error to be returned")
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the group to stop")
+	}
+}
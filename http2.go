@@ -0,0 +1,32 @@
+//go:build go1.24
+// +build go1.24
+
+package graceful
+
+import "net/http"
+
+// configureH2C enables HTTP/2 over cleartext connections if H2C is set.
+// net/http serves these connections itself rather than hijacking them, so
+// they are managed like any other connection and their streams are drained.
+func (srv *Server) configureH2C() error {
+	if !srv.H2C {
+		return nil
+	}
+	if srv.Protocols == nil {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(srv.TLSNextProto == nil)
+	}
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	return nil
+}
+
+// offersHTTP2 reports whether a TLS listener created by graceful should
+// negotiate HTTP/2. The http.Server only serves HTTP/2 over TLS when it has
+// not been given a TLSConfig or TLSNextProto of its own.
+func (srv *Server) offersHTTP2() bool {
+	if srv.Protocols != nil && !srv.Protocols.HTTP2() {
+		return false
+	}
+	return srv.TLSConfig == nil && srv.TLSNextProto == nil
+}
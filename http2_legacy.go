@@ -0,0 +1,22 @@
+//go:build !go1.24
+// +build !go1.24
+
+package graceful
+
+import "errors"
+
+// configureH2C returns an error if H2C is set, as serving h2c without
+// hijacking connections requires Go 1.24.
+func (srv *Server) configureH2C() error {
+	if !srv.H2C {
+		return nil
+	}
+	return errors.New("graceful: h2c requires Go 1.24 or later")
+}
+
+// offersHTTP2 reports whether a TLS listener created by graceful should
+// negotiate HTTP/2. The http.Server only serves HTTP/2 over TLS when it has
+// not been given a TLSConfig or TLSNextProto of its own.
+func (srv *Server) offersHTTP2() bool {
+	return srv.TLSConfig == nil && srv.TLSNextProto == nil
+}
@@ -0,0 +1,67 @@
+//go:build go1.24
+// +build go1.24
+
+package graceful
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestH2CDrainsStreams(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime)
+		io.WriteString(rw, r.Proto)
+	})
+	srv := &Server{
+		Timeout:          timeoutTime,
+		H2C:              true,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: mux},
+		NoSignalHandling: true,
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	type result struct {
+		proto string
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		client := http.Client{Transport: &http.Transport{Protocols: protocols}}
+		r, err := client.Get("http://" + srv.ListenerAddr().String())
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer r.Body.Close()
+		body, err := io.ReadAll(r.Body)
+		results <- result{string(body), err}
+	}()
+
+	time.Sleep(waitTime)
+	if n := srv.ActiveConnections(); n != 1 {
+		t.Errorf("Expected the h2c connection to be managed. Got %d", n)
+	}
+	srv.Stop(timeoutTime)
+
+	res := <-results
+	if res.err != nil {
+		t.Fatal("Expected the active stream to finish:", res.err)
+	}
+	if res.proto != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2.0 over cleartext. Got %q", res.proto)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected the h2c connection to be closed once idle")
+	}
+}
@@ -0,0 +1,146 @@
+package graceful
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// TrackingListener wraps a net.Listener and keeps track of the connections
+// it accepts, so that servers other than http.Server, such as fcgi.Serve or
+// any other Serve(net.Listener) style server, can be shut down gracefully.
+// Connections are only known to be finished once they are closed, as there
+// is no notion of an idle connection.
+//
+// Example:
+//	tl := graceful.NewTrackingListener(l)
+//	go fcgi.Serve(tl, handler)
+//	<-ctx.Done()
+//	err := tl.Shutdown(10 * time.Second)
+type TrackingListener struct {
+	net.Listener
+
+	// lock protects conns, closing and drained.
+	lock    sync.Mutex
+	conns   map[*trackedConn]struct{}
+	closing bool
+
+	// drained is closed once the listener is closing and the last
+	// connection has been closed.
+	drained chan struct{}
+}
+
+// NewTrackingListener returns a TrackingListener accepting connections from l.
+func NewTrackingListener(l net.Listener) *TrackingListener {
+	return &TrackingListener{
+		Listener: l,
+		conns:    map[*trackedConn]struct{}{},
+		drained:  make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection, which is tracked until
+// it is closed. Connections accepted once Shutdown has been called are
+// closed immediately.
+func (l *TrackingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		tc := &trackedConn{Conn: conn, listener: l}
+		l.lock.Lock()
+		closing := l.closing
+		if !closing {
+			l.conns[tc] = struct{}{}
+		}
+		l.lock.Unlock()
+
+		if !closing {
+			return tc, nil
+		}
+		_ = conn.Close() // it was accepted too late to be served
+	}
+}
+
+// ActiveConnections returns the number of accepted connections which have
+// not been closed yet.
+func (l *TrackingListener) ActiveConnections() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.conns)
+}
+
+// Shutdown closes the listener and waits for the accepted connections to be
+// closed by the server. Once timeout has passed, the remaining connections
+// are closed and ErrDrainTimeout is returned. If timeout is 0, Shutdown
+// waits for as long as the connections stay open, and if it is negative,
+// the connections are closed immediately.
+func (l *TrackingListener) Shutdown(timeout time.Duration) error {
+	err := l.Listener.Close()
+
+	l.lock.Lock()
+	if !l.closing {
+		l.closing = true
+		if len(l.conns) == 0 {
+			close(l.drained)
+		}
+	}
+	l.lock.Unlock()
+
+	if timeout >= 0 {
+		var timedOut <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			timedOut = timer.C
+		}
+		select {
+		case <-l.drained:
+			return err
+		case <-timedOut:
+		}
+	}
+
+	l.lock.Lock()
+	conns := make([]*trackedConn, 0, len(l.conns))
+	for conn := range l.conns {
+		conns = append(conns, conn)
+	}
+	l.lock.Unlock()
+
+	if len(conns) == 0 {
+		return err
+	}
+	for _, conn := range conns {
+		_ = conn.Close() // nothing to do here if it errors
+	}
+	return ErrDrainTimeout
+}
+
+// remove stops tracking conn, closing drained if it was the last one.
+func (l *TrackingListener) remove(conn *trackedConn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.conns[conn]; !ok {
+		return
+	}
+	delete(l.conns, conn)
+	if l.closing && len(l.conns) == 0 {
+		close(l.drained)
+	}
+}
+
+// trackedConn is a connection accepted by a TrackingListener, which stops
+// being tracked once it is closed.
+type trackedConn struct {
+	net.Conn
+	listener *TrackingListener
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.listener.remove(c)
+	return err
+}
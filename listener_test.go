@@ -0,0 +1,89 @@
+package graceful
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveLines answers every line received on a connection accepted from l
+// after delay, closing the connection once the client does.
+func serveLines(l net.Listener, delay time.Duration) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				time.Sleep(delay)
+				io.WriteString(conn, line)
+			}
+		}()
+	}
+}
+
+func TestTrackingListenerDrains(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := NewTrackingListener(l)
+	go serveLines(tl, killTime)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "hello\n")
+	go func() {
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+	}()
+	time.Sleep(waitTime)
+
+	if n := tl.ActiveConnections(); n != 1 {
+		t.Fatalf("Expected 1 active connection. Got %d", n)
+	}
+	if err := tl.Shutdown(timeoutTime); err != nil {
+		t.Fatalf("Expected the connection to drain. Got %v", err)
+	}
+	if n := tl.ActiveConnections(); n != 0 {
+		t.Errorf("Expected no active connections. Got %d", n)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("Expected the listener to be closed")
+	}
+}
+
+func TestTrackingListenerTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := NewTrackingListener(l)
+	go serveLines(tl, 0)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(waitTime)
+
+	if err := tl.Shutdown(killTime); err != ErrDrainTimeout {
+		t.Fatalf("Expected %v. Got %v", ErrDrainTimeout, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(killTime))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed. Got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Package metrics exports the state of a graceful.Server to Prometheus. It is
+// kept apart from graceful so that only programs using it depend on the
+// Prometheus client.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tylerb/graceful"
+)
+
+// Collector is a prometheus.Collector reporting the connections of a
+// graceful.Server and how its last shutdown drained them. The metrics are
+// read from the server each time they are collected, so the collector may
+// be registered before the server is served.
+//
+// Example:
+//	prometheus.MustRegister(metrics.NewCollector(srv, nil))
+type Collector struct {
+	srv *graceful.Server
+
+	active       *prometheus.Desc
+	total        *prometheus.Desc
+	shuttingDown *prometheus.Desc
+	lastDrain    *prometheus.Desc
+	killed       *prometheus.Desc
+}
+
+// NewCollector returns a Collector for srv. labels are added to every
+// metric, to tell apart the servers of a process which registers several
+// collectors; they may be nil.
+func NewCollector(srv *graceful.Server, labels prometheus.Labels) *Collector {
+	return &Collector{
+		srv: srv,
+		active: prometheus.NewDesc("graceful_active_connections",
+			"Number of connections currently open, including idle keep-alive connections.", nil, labels),
+		total: prometheus.NewDesc("graceful_connections_total",
+			"Number of connections accepted.", nil, labels),
+		shuttingDown: prometheus.NewDesc("graceful_shutting_down",
+			"Whether a shutdown has been initiated (1) or not (0).", nil, labels),
+		lastDrain: prometheus.NewDesc("graceful_last_drain_seconds",
+			"Time the last completed shutdown took to drain its connections.", nil, labels),
+		killed: prometheus.NewDesc("graceful_killed_connections_total",
+			"Number of connections closed forcefully while draining.", nil, labels),
+	}
+}
+
+// Describe sends the descriptors of the collector's metrics to ch.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.active
+	ch <- c.total
+	ch <- c.shuttingDown
+	ch <- c.lastDrain
+	ch <- c.killed
+}
+
+// Collect sends the current values of the collector's metrics to ch. The last
+// drain duration is only sent once the server has completed a shutdown.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	shuttingDown := 0.0
+	if c.srv.IsShuttingDown() {
+		shuttingDown = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(c.srv.ActiveConnections()))
+	ch <- prometheus.MustNewConstMetric(c.total, prometheus.CounterValue, float64(c.srv.TotalConnections()))
+	ch <- prometheus.MustNewConstMetric(c.shuttingDown, prometheus.GaugeValue, shuttingDown)
+	if stats, ok := c.srv.LastShutdown(); ok {
+		ch <- prometheus.MustNewConstMetric(c.lastDrain, prometheus.GaugeValue, stats.Drain.Seconds())
+	}
+	ch <- prometheus.MustNewConstMetric(c.killed, prometheus.CounterValue, float64(c.srv.KilledConnections()))
+}
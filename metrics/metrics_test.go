@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tylerb/graceful"
+	"github.com/tylerb/graceful/gracefultest"
+)
+
+// gather returns the values of the metrics registered with reg, by name.
+func gather(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			if m.GetLabel()[0].GetValue() != "public" {
+				t.Errorf("Expected %s to be labelled. Got %v", f.GetName(), m.GetLabel())
+			}
+			if g := m.GetGauge(); g != nil {
+				values[f.GetName()] = g.GetValue()
+			} else {
+				values[f.GetName()] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestCollector(t *testing.T) {
+	ts := gracefultest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	ts.Config.Timeout = 100 * time.Millisecond
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewCollector(ts.Config, prometheus.Labels{"server": "public"}))
+	ts.Start()
+
+	go func() {
+		if r, err := http.Get(ts.URL); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	values := gather(t, reg)
+	if values["graceful_active_connections"] != 1 || values["graceful_connections_total"] != 1 {
+		t.Errorf("Expected 1 active connection of 1 accepted. Got %v", values)
+	}
+	if values["graceful_shutting_down"] != 0 {
+		t.Errorf("Expected the server not to be shutting down. Got %v", values)
+	}
+	if _, ok := values["graceful_last_drain_seconds"]; ok {
+		t.Errorf("Expected no drain duration before shutting down. Got %v", values)
+	}
+
+	ts.TriggerShutdown()
+	if err := ts.Wait(); !errors.Is(err, graceful.ErrDrainTimeout) {
+		t.Fatalf("Expected %v. Got %v", graceful.ErrDrainTimeout, err)
+	}
+
+	values = gather(t, reg)
+	if values["graceful_active_connections"] != 0 || values["graceful_killed_connections_total"] != 1 {
+		t.Errorf("Expected the connection to have been killed. Got %v", values)
+	}
+	if values["graceful_shutting_down"] != 1 {
+		t.Errorf("Expected the server to be shutting down. Got %v", values)
+	}
+	if d := values["graceful_last_drain_seconds"]; d < 0.1 {
+		t.Errorf("Expected the drain to take at least the timeout. Got %vs", d)
+	}
+}
@@ -0,0 +1,194 @@
+package graceful
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Option configures a Server created by New.
+type Option func(*Server)
+
+// New returns a Server listening on addr once served, configured by opts. It
+// is equivalent to setting the corresponding fields of a Server directly, and
+// serves http.DefaultServeMux unless WithHandler is given.
+//
+// Example:
+//	srv := graceful.New(":1234",
+//		graceful.WithHandler(mux),
+//		graceful.WithTimeout(10*time.Second),
+//	)
+//	srv.ListenAndServe()
+func New(addr string, opts ...Option) *Server {
+	srv := &Server{Server: &http.Server{Addr: addr}}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
+}
+
+// WithHandler sets the handler serving requests.
+func WithHandler(h http.Handler) Option {
+	return func(srv *Server) {
+		srv.Handler = h
+	}
+}
+
+// WithHTTPServer calls configure with the underlying http.Server, to set
+// fields which no option covers, such as MaxHeaderBytes or ConnContext. The
+// caveats of the Server field apply.
+func WithHTTPServer(configure func(*http.Server)) Option {
+	return func(srv *Server) {
+		configure(srv.Server)
+	}
+}
+
+// WithTimeout sets Timeout, the duration to allow requests to finish once
+// shutdown begins.
+func WithTimeout(timeout time.Duration) Option {
+	return func(srv *Server) {
+		srv.Timeout = timeout
+	}
+}
+
+// WithIdleTimeout sets the IdleTimeout of the underlying http.Server, after
+// which idle keep-alive connections are closed by the server, so that fewer
+// are left open for the shutdown to close.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(srv *Server) {
+		srv.IdleTimeout = timeout
+	}
+}
+
+// WithSignals sets the signals which initiate a shutdown.
+func WithSignals(sigs ...os.Signal) Option {
+	return func(srv *Server) {
+		srv.Signals = sigs
+	}
+}
+
+// WithoutSignalHandling sets NoSignalHandling, so that the server is only
+// shut down by Stop, Shutdown or a context.
+func WithoutSignalHandling() Option {
+	return func(srv *Server) {
+		srv.NoSignalHandling = true
+	}
+}
+
+// WithoutConnectionTracking sets NoConnectionTracking, so that the server
+// serves like a plain http.Server, without draining its connections on
+// shutdown.
+func WithoutConnectionTracking() Option {
+	return func(srv *Server) {
+		srv.NoConnectionTracking = true
+	}
+}
+
+// WithLogger sets the logger used to report shutdown progress.
+func WithLogger(logger *log.Logger) Option {
+	return func(srv *Server) {
+		srv.Logger = logger
+	}
+}
+
+// WithShutdownInitiated sets the ShutdownInitiated callback, called as soon
+// as shutdown begins.
+func WithShutdownInitiated(f func()) Option {
+	return func(srv *Server) {
+		srv.ShutdownInitiated = f
+	}
+}
+
+// WithMaxConnections sets MaxConnections, the number of connections served
+// at once.
+func WithMaxConnections(n int) Option {
+	return func(srv *Server) {
+		srv.MaxConnections = n
+	}
+}
+
+// WithShutdownDelay sets ShutdownDelay, the duration to keep serving once
+// shutdown begins.
+func WithShutdownDelay(delay time.Duration) Option {
+	return func(srv *Server) {
+		srv.ShutdownDelay = delay
+	}
+}
+
+// WithKeepAlive sets KeepAliveTimeout and KeepAliveMax, the keep-alive
+// parameters advertised to clients, which are tightened during the
+// ShutdownDelay.
+func WithKeepAlive(timeout time.Duration, max int) Option {
+	return func(srv *Server) {
+		srv.KeepAliveTimeout = timeout
+		srv.KeepAliveMax = max
+	}
+}
+
+// WithShutdownFile sets ShutdownFile and ShutdownFileInterval, so that
+// creating or changing the file at path initiates a shutdown.
+func WithShutdownFile(path string, interval time.Duration) Option {
+	return func(srv *Server) {
+		srv.ShutdownFile = path
+		srv.ShutdownFileInterval = interval
+	}
+}
+
+// WithRequestPriority sets RequestPriority, which classifies requests so that
+// connections serving lower-priority ones are closed first as the timeout
+// approaches.
+func WithRequestPriority(priority func(r *http.Request) int) Option {
+	return func(srv *Server) {
+		srv.RequestPriority = priority
+	}
+}
+
+// WithUnlinkOnShutdown sets UnlinkOnShutdown, whether the file of a unix
+// socket being served is removed on shutdown.
+func WithUnlinkOnShutdown(unlink bool) Option {
+	return func(srv *Server) {
+		srv.UnlinkOnShutdown = &unlink
+	}
+}
+
+// WithTracker sets Tracker, which is kept in step with the connections the
+// server manages.
+func WithTracker(tracker ConnTracker) Option {
+	return func(srv *Server) {
+		srv.Tracker = tracker
+	}
+}
+
+// WithWaitGroup sets WaitGroup, background work the shutdown waits for once
+// the connections have drained.
+func WithWaitGroup(wg *sync.WaitGroup) Option {
+	return func(srv *Server) {
+		srv.WaitGroup = wg
+	}
+}
+
+// EndpointsPropagationDelay is the ShutdownDelay WithKubernetes uses by
+// default, long enough for a pod's removal from its Service endpoints to
+// reach kube-proxy and ingress controllers in most clusters.
+const EndpointsPropagationDelay = 5 * time.Second
+
+// WithKubernetes configures the server to shut down cleanly when its pod is
+// terminated. Kubernetes sends SIGTERM, one of the default signals, while
+// the pod is still being removed from its Service endpoints, so the server
+// keeps serving for delay, reporting IsShuttingDown, before closing its
+// listener. Keep-alives are disabled throughout the delay, so that clients
+// move to other pods. If delay is 0, EndpointsPropagationDelay is used.
+//
+// The pod's terminationGracePeriodSeconds should exceed the delay plus the
+// Timeout, or the kubelet kills the process before the drain finishes.
+func WithKubernetes(delay time.Duration) Option {
+	if delay == 0 {
+		delay = EndpointsPropagationDelay
+	}
+	return func(srv *Server) {
+		srv.ShutdownDelay = delay
+		srv.DrainKeepAlives = true
+	}
+}
@@ -0,0 +1,219 @@
+package graceful
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	mux := http.NewServeMux()
+	logger := log.New(os.Stderr, "", 0)
+	initiated := false
+
+	srv := New("127.0.0.1:0",
+		WithHandler(mux),
+		WithTimeout(killTime),
+		WithSignals(os.Interrupt),
+		WithLogger(logger),
+		WithShutdownInitiated(func() { initiated = true }),
+		WithMaxConnections(10),
+		WithShutdownDelay(waitTime),
+		WithUnlinkOnShutdown(false),
+	)
+
+	if srv.Addr != "127.0.0.1:0" || srv.Handler != mux {
+		t.Errorf("Expected the address and handler to be set. Got %q and %v", srv.Addr, srv.Handler)
+	}
+	if srv.Timeout != killTime || srv.ShutdownDelay != waitTime || srv.MaxConnections != 10 {
+		t.Errorf("Unexpected settings %v, %v, %d", srv.Timeout, srv.ShutdownDelay, srv.MaxConnections)
+	}
+	if srv.UnlinkOnShutdown == nil || *srv.UnlinkOnShutdown {
+		t.Errorf("Expected UnlinkOnShutdown to be false. Got %v", srv.UnlinkOnShutdown)
+	}
+	if !reflect.DeepEqual(srv.Signals, []os.Signal{os.Interrupt}) || srv.Logger != logger {
+		t.Errorf("Expected the signals and logger to be set")
+	}
+	srv.ShutdownInitiated()
+	if !initiated {
+		t.Error("Expected the ShutdownInitiated callback to be set")
+	}
+}
+
+func TestWithHTTPServer(t *testing.T) {
+	type key struct{}
+	srv := New("127.0.0.1:0",
+		WithHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Context().Value(key{}) != "conn" {
+				t.Error("Expected the ConnContext to be used")
+			}
+		})),
+		WithTimeout(killTime),
+		WithoutSignalHandling(),
+		WithHTTPServer(func(hs *http.Server) {
+			hs.MaxHeaderBytes = 4096
+			hs.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+				return context.WithValue(ctx, key{}, "conn")
+			}
+		}),
+	)
+	if srv.MaxHeaderBytes != 4096 {
+		t.Errorf("Expected MaxHeaderBytes to be set. Got %d", srv.MaxHeaderBytes)
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	r, err := http.Get("http://" + srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	srv.Stop(killTime)
+	<-stopped
+}
+
+func TestWithIdleTimeout(t *testing.T) {
+	srv := New("127.0.0.1:0", WithHandler(http.NewServeMux()), WithoutSignalHandling(), WithIdleTimeout(waitTime))
+	if srv.IdleTimeout != waitTime {
+		t.Errorf("Expected IdleTimeout to be set. Got %v", srv.IdleTimeout)
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	r, err := http.Get("http://" + srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if n := srv.ActiveConnections(); n != 1 {
+		t.Errorf("Expected the keep-alive connection to be open. Got %d", n)
+	}
+	time.Sleep(3 * waitTime)
+	if n := srv.ActiveConnections(); n != 0 {
+		t.Errorf("Expected the idle connection to have been closed. Got %d", n)
+	}
+
+	srv.Stop(killTime)
+	<-stopped
+}
+
+func TestNewServes(t *testing.T) {
+	srv := New("127.0.0.1:0", WithHandler(http.NewServeMux()), WithTimeout(killTime), WithoutSignalHandling())
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	r, err := http.Get("http://" + srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	srv.Stop(killTime)
+	select {
+	case <-stopped:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out waiting for the server to stop")
+	}
+}
+
+func TestWithKubernetes(t *testing.T) {
+	srv := New("127.0.0.1:0", WithKubernetes(0))
+	if srv.ShutdownDelay != EndpointsPropagationDelay || !srv.DrainKeepAlives {
+		t.Errorf("Expected the default propagation delay with keep-alives drained. Got %v and %v", srv.ShutdownDelay, srv.DrainKeepAlives)
+	}
+
+	srv = New("127.0.0.1:0", WithHandler(http.NewServeMux()), WithTimeout(killTime), WithoutSignalHandling(), WithKubernetes(killTime))
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	srv.Stop(killTime)
+	<-srv.ShuttingDown()
+	if !srv.IsShuttingDown() {
+		t.Error("Expected the server to report that it is shutting down during the delay")
+	}
+	r, err := http.Get("http://" + srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal("Expected the server to keep serving during the delay:", err)
+	}
+	r.Body.Close()
+	<-stopped
+}
+
+func TestWithKeepAlive(t *testing.T) {
+	srv := New("127.0.0.1:0", WithKeepAlive(5*time.Second, 10))
+	if srv.KeepAliveTimeout != 5*time.Second || srv.KeepAliveMax != 10 {
+		t.Errorf("Expected the keep-alive parameters to be set. Got %v and %d", srv.KeepAliveTimeout, srv.KeepAliveMax)
+	}
+
+	srv.DrainKeepAlives = true
+	if h := srv.keepAlive(); h != "timeout=5, max=10" {
+		t.Errorf("Expected the parameters to be advertised before shutdown. Got %q", h)
+	}
+	srv.initiated = time.Now()
+	if h := srv.keepAlive(); h != "" {
+		t.Errorf("Expected no header once keep-alives are drained. Got %q", h)
+	}
+}
+
+func TestWithShutdownFile(t *testing.T) {
+	srv := New("127.0.0.1:0", WithShutdownFile("/run/app/stop", time.Minute))
+	if srv.ShutdownFile != "/run/app/stop" || srv.ShutdownFileInterval != time.Minute {
+		t.Errorf("Expected the shutdown file to be set. Got %q every %v", srv.ShutdownFile, srv.ShutdownFileInterval)
+	}
+}
+
+func TestWithRequestPriority(t *testing.T) {
+	srv := New("127.0.0.1:0", WithRequestPriority(func(r *http.Request) int { return 7 }))
+	if srv.RequestPriority == nil || srv.RequestPriority(&http.Request{}) != 7 {
+		t.Error("Expected RequestPriority to be set")
+	}
+}
+
+func TestWithWaitGroup(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	finished := false
+	go func() {
+		time.Sleep(killTime)
+		finished = true
+		wg.Done()
+	}()
+
+	srv := New("127.0.0.1:0", WithHandler(http.NewServeMux()), WithTimeout(timeoutTime), WithoutSignalHandling(), WithWaitGroup(&wg))
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	srv.Stop(timeoutTime)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !finished {
+		t.Error("Expected shutdown to wait for the WaitGroup")
+	}
+
+	// The timeout still bounds the wait.
+	wg.Add(1)
+	defer wg.Done()
+	srv = New("127.0.0.1:0", WithHandler(http.NewServeMux()), WithTimeout(waitTime), WithoutSignalHandling(), WithWaitGroup(&wg))
+	go func() { errc <- srv.ListenAndServe() }()
+	<-srv.Ready()
+
+	srv.Stop(waitTime)
+	select {
+	case <-errc:
+	case <-time.After(timeoutTime):
+		t.Fatal("Expected the timeout to end the wait for the WaitGroup")
+	}
+}
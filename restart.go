@@ -0,0 +1,155 @@
+//go:build !windows
+// +build !windows
+
+package graceful
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// listenerFDEnv is the environment variable holding the file descriptor of
+// the listener inherited from the parent process.
+const listenerFDEnv = "GRACEFUL_LISTENER_FD"
+
+// Restart starts a new copy of the running executable with the same arguments
+// and environment, handing it the server's listening socket so that no
+// connections are refused. Once the new process has started, the server is
+// stopped and drains its outstanding connections as if Stop(srv.Timeout) had
+// been called.
+//
+// The new process picks up the socket when a server with the same Network
+// and Addr calls ListenAndServe, ListenAndServeTLS or ListenAndServeTLSConfig,
+// or it may retrieve it with InheritedListener. Only listeners created by those methods can be handed off.
+func (srv *Server) Restart() error {
+	srv.stopLock.RLock()
+	l := srv.listener
+	srv.stopLock.RUnlock()
+
+	filer, ok := l.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return errors.New("graceful: listener cannot be handed off")
+	}
+	f, err := filer.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// The socket is the first file after stdin, stdout and stderr.
+	attr := &os.ProcAttr{
+		Env:   append(os.Environ(), listenerFDEnv+"=3"),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, f},
+	}
+	if _, err := os.StartProcess(path, os.Args, attr); err != nil {
+		return err
+	}
+
+	// The new process now owns the socket file of a unix socket.
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	srv.stopLock.Lock()
+	srv.handedOff = true
+	srv.stopLock.Unlock()
+
+	srv.logger().Printf("restarted, handing off listener on %s", l.Addr())
+	srv.Stop(srv.Timeout)
+	return nil
+}
+
+// inherited holds the listener handed to this process by Restart, once it
+// has been opened and until it is taken. It is protected by inheritedLock.
+var (
+	inheritedLock sync.Mutex
+	inherited     net.Listener
+)
+
+// openInherited opens the listener handed to this process by Restart, if it
+// has not been already. It must be called with inheritedLock held.
+func openInherited() error {
+	fd := os.Getenv(listenerFDEnv)
+	if fd == "" {
+		return nil
+	}
+	os.Unsetenv(listenerFDEnv)
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return errors.New("graceful: invalid " + listenerFDEnv + ": " + fd)
+	}
+	f := os.NewFile(uintptr(n), "listener")
+	defer f.Close()
+	inherited, err = net.FileListener(f)
+	return err
+}
+
+// InheritedListener returns the listener handed to this process by Restart,
+// or nil if there is none. It can only be retrieved once, and is then no
+// longer picked up by ListenAndServe.
+func InheritedListener() (net.Listener, error) {
+	inheritedLock.Lock()
+	defer inheritedLock.Unlock()
+	if err := openInherited(); err != nil {
+		return nil, err
+	}
+	l := inherited
+	inherited = nil
+	return l, nil
+}
+
+// inheritedListener returns the listener handed to this process by Restart
+// if it listens on addr in network, as the one handed off by a server with
+// the same configuration would, or nil otherwise. A listener which does not
+// match is kept for another server, so that a process running several
+// servers, only one of which restarted it, gives each its own socket.
+func inheritedListener(network, addr string) (net.Listener, error) {
+	inheritedLock.Lock()
+	defer inheritedLock.Unlock()
+	if err := openInherited(); err != nil {
+		return nil, err
+	}
+	if inherited == nil || !listensOn(inherited.Addr(), network, addr) {
+		return nil, nil
+	}
+	l := inherited
+	inherited = nil
+	return l, nil
+}
+
+// listensOn reports whether a listener on have serves addr in network. An
+// unspecified host matches any unspecified address. Port 0 matches no
+// listener, as the port chosen for it cannot be told apart from another
+// server's.
+func listensOn(have net.Addr, network, addr string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		tcp, ok := have.(*net.TCPAddr)
+		if !ok {
+			return false
+		}
+		want, err := net.ResolveTCPAddr(network, addr)
+		if err != nil {
+			return false
+		}
+		if want.Port != tcp.Port {
+			return false
+		}
+		if want.IP == nil || want.IP.IsUnspecified() {
+			return tcp.IP == nil || tcp.IP.IsUnspecified()
+		}
+		return want.IP.Equal(tcp.IP)
+	default:
+		return have.Network() == network && have.String() == addr
+	}
+}
@@ -0,0 +1,147 @@
+//go:build !windows
+// +build !windows
+
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// inherit hands a listener on a system-chosen loopback port to this process
+// as Restart does, returning its address.
+func inherit(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	l.Close()
+
+	os.Setenv(listenerFDEnv, strconv.Itoa(fd))
+	return addr
+}
+
+func TestListenAndServeUsesInheritedListener(t *testing.T) {
+	addr := inherit(t)
+	defer os.Unsetenv(listenerFDEnv)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	srv := &Server{
+		Timeout:          killTime,
+		Server:           &http.Server{Addr: addr, Handler: mux},
+		NoSignalHandling: true,
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	time.Sleep(waitTime)
+
+	if os.Getenv(listenerFDEnv) != "" {
+		t.Error("Expected the inherited listener to be consumed")
+	}
+
+	r, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal("Expected the server to serve on the inherited listener:", err)
+	}
+	r.Body.Close()
+
+	srv.Stop(killTime)
+	<-stopped
+}
+
+func TestInheritedListenerMatchesAddr(t *testing.T) {
+	addr := inherit(t)
+	defer os.Unsetenv(listenerFDEnv)
+
+	// A server on another address, opened first, must leave the inherited
+	// listener to the server it was handed off by.
+	admin := &Server{
+		Timeout:          killTime,
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()},
+		NoSignalHandling: true,
+	}
+	adminStopped := admin.StopChan()
+	go admin.ListenAndServe()
+	<-admin.Ready()
+	if got := admin.ListenerAddr().String(); got == addr {
+		t.Errorf("Expected the admin server not to take the inherited listener on %s", addr)
+	}
+
+	api := &Server{
+		Timeout:          killTime,
+		Server:           &http.Server{Addr: addr, Handler: http.NewServeMux()},
+		NoSignalHandling: true,
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- api.ListenAndServe() }()
+	select {
+	case <-api.Ready():
+	case err := <-errc:
+		t.Fatalf("Expected the API server to serve on the inherited listener. Got %v", err)
+	}
+	if got := api.ListenerAddr().String(); got != addr {
+		t.Errorf("Expected the API server to serve on %s. Got %s", addr, got)
+	}
+
+	admin.Stop(killTime)
+	api.Stop(killTime)
+	<-adminStopped
+	<-errc
+}
+
+func TestListensOn(t *testing.T) {
+	tcp := func(s string) net.Addr {
+		a, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	for _, c := range []struct {
+		have    net.Addr
+		network string
+		addr    string
+		want    bool
+	}{
+		{tcp("127.0.0.1:8080"), "tcp", "127.0.0.1:8080", true},
+		{tcp("127.0.0.1:8080"), "tcp", "127.0.0.1:9090", false},
+		{tcp("127.0.0.1:8080"), "tcp", "127.0.0.2:8080", false},
+		{tcp("[::]:8080"), "tcp", ":8080", true},
+		{tcp("0.0.0.0:8080"), "tcp4", "0.0.0.0:8080", true},
+		{tcp("[::]:8080"), "tcp", "127.0.0.1:8080", false},
+		{tcp("127.0.0.1:8080"), "tcp", "127.0.0.1:0", false},
+		{tcp("127.0.0.1:8080"), "unix", "/run/app.sock", false},
+		{&net.UnixAddr{Name: "/run/app.sock", Net: "unix"}, "unix", "/run/app.sock", true},
+		{&net.UnixAddr{Name: "/run/app.sock", Net: "unix"}, "unix", "/run/admin.sock", false},
+	} {
+		if got := listensOn(c.have, c.network, c.addr); got != c.want {
+			t.Errorf("listensOn(%v, %q, %q) = %v, want %v", c.have, c.network, c.addr, got, c.want)
+		}
+	}
+}
+
+func TestRestartRequiresOwnListener(t *testing.T) {
+	srv := &Server{Server: &http.Server{}}
+	if err := srv.Restart(); err == nil {
+		t.Fatal("Expected an error when there is no listener to hand off")
+	}
+}
@@ -0,0 +1,22 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+)
+
+// Restart is not supported on Windows, where listening sockets cannot be
+// handed to a new process.
+func (srv *Server) Restart() error {
+	return errors.New("graceful: restart is not supported on windows")
+}
+
+// InheritedListener always returns nil on Windows.
+func InheritedListener() (net.Listener, error) {
+	return nil, nil
+}
+
+// inheritedListener always returns nil on Windows.
+func inheritedListener(network, addr string) (net.Listener, error) {
+	return nil, nil
+}
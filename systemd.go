@@ -0,0 +1,64 @@
+//go:build !windows
+// +build !windows
+
+package graceful
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// systemdFirstFD is the first file descriptor passed by systemd socket
+// activation, after stdin, stdout and stderr.
+var systemdFirstFD = 3
+
+// systemdTaken holds the descriptors already retrieved by
+// ListenerFromSystemd, which are closed and may since have been reused. It is
+// protected by systemdLock.
+var (
+	systemdLock  sync.Mutex
+	systemdTaken = map[int]bool{}
+)
+
+// ListenerFromSystemd returns the listener passed to this process by systemd
+// socket activation under name, as set by FileDescriptorName= in the socket
+// unit. The LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment variables
+// describe the inherited sockets, and an error is returned if they are
+// missing, were meant for another process, or do not include name. Each
+// socket can only be retrieved once. The listener can then be served with
+// ServeListener or Server.Serve.
+func ListenerFromSystemd(name string) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil {
+		return nil, errors.New("graceful: not started by systemd socket activation: LISTEN_PID is not set")
+	}
+	if pid != os.Getpid() {
+		return nil, errors.New("graceful: LISTEN_PID " + strconv.Itoa(pid) + " does not match this process")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("graceful: no sockets passed by systemd: LISTEN_FDS is " + strconv.Quote(os.Getenv("LISTEN_FDS")))
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i, fdName := range names {
+		if fdName != name || i >= n {
+			continue
+		}
+		fd := systemdFirstFD + i
+		systemdLock.Lock()
+		defer systemdLock.Unlock()
+		if systemdTaken[fd] {
+			return nil, errors.New("graceful: socket " + strconv.Quote(name) + " passed by systemd was already retrieved")
+		}
+		systemdTaken[fd] = true
+		f := os.NewFile(uintptr(fd), name)
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return nil, errors.New("graceful: no socket named " + strconv.Quote(name) + " passed by systemd")
+}
@@ -0,0 +1,70 @@
+//go:build !windows
+// +build !windows
+
+package graceful
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenerFromSystemd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The named socket is the second one passed, so it is expected at the
+	// first descriptor plus one.
+	defer func(first int) { systemdFirstFD = first }(systemdFirstFD)
+	systemdFirstFD = fd - 1
+	defer func(taken map[int]bool) { systemdTaken = taken }(systemdTaken)
+	systemdTaken = map[int]bool{}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "2")
+	t.Setenv("LISTEN_FDNAMES", "admin:http")
+
+	if _, err := ListenerFromSystemd("metrics"); err == nil {
+		t.Error("Expected an error for a socket name that was not passed")
+	}
+
+	inherited, err := ListenerFromSystemd("http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	if inherited.Addr().String() != l.Addr().String() {
+		t.Errorf("Expected a listener on %s. Got %s", l.Addr(), inherited.Addr())
+	}
+
+	// The descriptor was closed once wrapped, so it may now hold another
+	// socket, which must not be returned as the one systemd passed.
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if again, err := ListenerFromSystemd("http"); err == nil {
+		again.Close()
+		t.Errorf("Expected an error retrieving the socket a second time. Got a listener on %s", again.Addr())
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	if _, err := ListenerFromSystemd("http"); err == nil {
+		t.Error("Expected an error when LISTEN_PID is for another process")
+	}
+}
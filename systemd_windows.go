@@ -0,0 +1,12 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenerFromSystemd is not supported on Windows, where there is no systemd
+// socket activation.
+func ListenerFromSystemd(name string) (net.Listener, error) {
+	return nil, errors.New("graceful: systemd socket activation is not supported on windows")
+}
@@ -0,0 +1,76 @@
+package graceful
+
+import (
+	"net"
+	"sync"
+)
+
+// ConnTracker keeps a set of connections on behalf of a Server, for example
+// to bucket them by client subnet. Set the Tracker field of a Server to have
+// it kept in step with the connections the Server manages. Its methods may
+// be called concurrently.
+type ConnTracker interface {
+	// Add is called with each connection as it is accepted.
+	Add(conn net.Conn)
+
+	// Remove is called with each connection once it is closed or
+	// hijacked, or spared by ShouldKill when the remaining connections are
+	// forcefully closed.
+	Remove(conn net.Conn)
+
+	// CloseAll closes the connections in the set. The Server calls it when
+	// its remaining connections are forcefully closed, once those spared
+	// by ShouldKill have been removed and before closing any left open
+	// itself, so that a tracker can choose the order in which they are
+	// closed.
+	CloseAll()
+}
+
+// ConnSet is a ConnTracker which keeps its connections in a map, as a Server
+// does itself. It can be embedded by trackers which only need to change
+// some of its behaviour.
+type ConnSet struct {
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewConnSet returns an empty ConnSet.
+func NewConnSet() *ConnSet {
+	return &ConnSet{conns: map[net.Conn]struct{}{}}
+}
+
+// Add adds conn to the set.
+func (s *ConnSet) Add(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.conns[conn] = struct{}{}
+}
+
+// Remove removes conn from the set.
+func (s *ConnSet) Remove(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, conn)
+}
+
+// Len returns the number of connections in the set.
+func (s *ConnSet) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.conns)
+}
+
+// CloseAll closes every connection in the set, and empties it.
+func (s *ConnSet) CloseAll() {
+	s.lock.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.lock.Unlock()
+
+	for conn := range conns {
+		_ = conn.Close() // nothing to do here if it errors
+	}
+}
@@ -0,0 +1,134 @@
+package graceful
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnSet(t *testing.T) {
+	set := NewConnSet()
+	a, b := net.Pipe()
+	defer b.Close()
+	c, d := net.Pipe()
+	defer d.Close()
+
+	set.Add(a)
+	set.Add(c)
+	if n := set.Len(); n != 2 {
+		t.Fatalf("Expected 2 connections. Got %d", n)
+	}
+	set.Remove(c)
+	if n := set.Len(); n != 1 {
+		t.Fatalf("Expected 1 connection once one was removed. Got %d", n)
+	}
+
+	set.CloseAll()
+	if n := set.Len(); n != 0 {
+		t.Errorf("Expected no connections once closed. Got %d", n)
+	}
+	if err := a.SetDeadline(time.Now()); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+	if err := c.SetDeadline(time.Now()); err != nil {
+		t.Error("Expected the removed connection to be left open:", err)
+	}
+}
+
+// closeCountingSet counts the calls to CloseAll.
+type closeCountingSet struct {
+	*ConnSet
+	closed int32
+}
+
+func (s *closeCountingSet) CloseAll() {
+	atomic.AddInt32(&s.closed, 1)
+	s.ConnSet.CloseAll()
+}
+
+func TestServerTracker(t *testing.T) {
+	tracker := &closeCountingSet{ConnSet: NewConnSet()}
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Tracker:          tracker,
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(timeoutTime * 2)
+			}
+		})},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	r, err := client.Get("http://" + srv.ListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	go func() {
+		if r, err := client.Get("http://" + srv.ListenerAddr().String() + "/slow"); err == nil {
+			r.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	if n := tracker.Len(); n != 1 {
+		t.Errorf("Expected the tracker to hold the 1 open connection. Got %d", n)
+	}
+
+	srv.Stop(killTime)
+	<-stopped
+	if n := atomic.LoadInt32(&tracker.closed); n != 1 {
+		t.Errorf("Expected CloseAll to be called once at the timeout. Got %d", n)
+	}
+	if n := tracker.Len(); n != 0 {
+		t.Errorf("Expected the tracker to be empty after stopping. Got %d", n)
+	}
+}
+
+func TestTrackerShouldKill(t *testing.T) {
+	var spared atomic.Value
+	spared.Store("")
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Tracker:          NewConnSet(),
+		ShouldKill:       func(conn net.Conn) bool { return conn.RemoteAddr().String() != spared.Load().(string) },
+		Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			time.Sleep(timeoutTime)
+		})},
+	}
+	stopped := srv.StopChan()
+	go srv.ListenAndServe()
+	<-srv.Ready()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", srv.ListenerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		conns = append(conns, conn)
+	}
+	spared.Store(conns[0].LocalAddr().String())
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	<-stopped
+	r, err := http.ReadResponse(bufio.NewReader(conns[0]), nil)
+	if err != nil {
+		t.Fatalf("Expected the tracker to leave the spared connection open. Got %v", err)
+	}
+	r.Body.Close()
+	if _, err := http.ReadResponse(bufio.NewReader(conns[1]), nil); err == nil {
+		t.Error("Expected the other connection to be closed")
+	}
+}